@@ -0,0 +1,11 @@
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package main
+
+import "os"
+
+// Whether we're allowed to create files in dir. Without access(2), the permissions it has are the best guess
+func dirWritable(dir string) bool {
+	fi, err := os.Stat(dir)
+	return err == nil && fi.IsDir() && fi.Mode().Perm()&0200 != 0
+}
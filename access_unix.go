@@ -0,0 +1,10 @@
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// Whether we're allowed to create files in dir, without actually creating any
+func dirWritable(dir string) bool {
+	return unix.Access(dir, unix.W_OK) == nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/crypto/ssh"
+)
+
+// Lifecycle of the server, as reported by the readiness probe
+type serverState struct {
+	accepting    atomic.Bool // Listener is up and accepting connections
+	shuttingDown atomic.Bool // We've been asked to stop and are waiting for connections to finish
+}
+
+// Body of the readiness probe's response
+type readiness struct {
+	Ready         bool     `json:"ready"`
+	Accepting     bool     `json:"accepting"`
+	ShuttingDown  bool     `json:"shutting_down"`
+	Dir           string   `json:"dir"`
+	DirReadable   bool     `json:"dir_readable"`
+	DirWritable   bool     `json:"dir_writable"`
+	HostKeyHashes []string `json:"host_keys"`
+}
+
+func dirReadable(dir string) bool {
+	f, err := os.Open(dir)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	_, err = f.Readdirnames(1)
+	// An empty directory is still readable
+	return err == nil || err == io.EOF
+}
+
+func (config scpConfig) checkReadiness() readiness {
+	r := readiness{
+		Accepting:    config.state.accepting.Load(),
+		ShuttingDown: config.state.shuttingDown.Load(),
+		Dir:          config.Dir,
+		DirReadable:  dirReadable(config.Dir),
+		DirWritable:  dirWritable(config.Dir),
+	}
+	if config.privateKey != nil {
+		r.HostKeyHashes = append(r.HostKeyHashes, ssh.FingerprintSHA256(config.privateKey.PublicKey()))
+	}
+	r.Ready = r.Accepting && !r.ShuttingDown && r.DirReadable && r.DirWritable
+	return r
+}
+
+// Liveness probe: if we can answer, we're alive
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"status":"ok"}` + "\n"))
+}
+
+// Readiness probe: only succeeds if we're able to serve files right now
+func (config scpConfig) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	status := config.checkReadiness()
+	w.Header().Set("Content-Type", "application/json")
+	if !status.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(status)
+}
+
+// Serve health probes and metrics over HTTP
+func startAdminServer(config *scpConfig) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/readyz", config.handleReadyz)
+
+	slog.Info("Serving admin endpoints", "addr", config.AdminAddr)
+	err := http.ListenAndServe(config.AdminAddr, mux)
+	if err != nil {
+		slog.Error("Admin server stopped", "err", err)
+	}
+}
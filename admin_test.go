@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadyz(t *testing.T) {
+	readOnly := filepath.Join(t.TempDir(), "readonly")
+	err := os.Mkdir(readOnly, 0500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(readOnly, 0700)
+
+	tests := []struct {
+		name         string
+		dir          string
+		shuttingDown bool
+		status       int
+	}{
+		{"ready", t.TempDir(), false, http.StatusOK},
+		{"shutting down", t.TempDir(), true, http.StatusServiceUnavailable},
+		{"missing dir", filepath.Join(t.TempDir(), "missing"), false, http.StatusServiceUnavailable},
+		{"read only dir", readOnly, false, http.StatusServiceUnavailable},
+	}
+	for _, test := range tests {
+		if test.dir == readOnly && dirWritable(readOnly) {
+			// Permissions don't stop root
+			t.Logf("%s: skipped, %s is writable anyway", test.name, readOnly)
+			continue
+		}
+		config := scpConfig{Dir: test.dir, state: &serverState{}}
+		config.state.accepting.Store(true)
+		config.state.shuttingDown.Store(test.shuttingDown)
+
+		w := httptest.NewRecorder()
+		config.handleReadyz(w, httptest.NewRequest("GET", "/readyz", nil))
+		if w.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.status, w.Code)
+		}
+		var body readiness
+		err := json.Unmarshal(w.Body.Bytes(), &body)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if body.Ready != (test.status == http.StatusOK) || body.ShuttingDown != test.shuttingDown {
+			t.Errorf("%s: unexpected body %s", test.name, w.Body.Bytes())
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Local admin API, served over HTTP on a unix socket:
+//   GET /sessions: List open connections and what they're transferring
+//   DELETE /sessions/<id>: Kill a connection
+//   GET /bans: List banned IPs
+//   POST /bans/<ip>: Ban an IP, killing its open connections
+//   DELETE /bans/<ip>: Lift a ban
+// Every request needs an "Authorization: Bearer <token>" header with the configured admin token.
+
+type transferInfo struct {
+	Path      string    `json:"path"`
+	Direction string    `json:"direction"`
+	Size      int64     `json:"size"`
+	Bytes     int64     `json:"bytes"`
+	Rate      float64   `json:"rate_bytes_per_sec"`
+	Started   time.Time `json:"started"`
+}
+
+type sessionInfo struct {
+	ID             string         `json:"id"`
+	User           string         `json:"user"`
+	ClientIP       string         `json:"client_ip"`
+	RemoteAddr     string         `json:"remote_addr"`
+	KeyFingerprint string         `json:"key_fingerprint,omitempty"`
+	Started        time.Time      `json:"started"`
+	Transfers      []transferInfo `json:"transfers"`
+}
+
+func describeSession(conn *connState) sessionInfo {
+	info := sessionInfo{
+		ID:             conn.sessionID,
+		User:           conn.user,
+		ClientIP:       conn.clientIP(),
+		RemoteAddr:     conn.remoteAddr.String(),
+		KeyFingerprint: conn.keyFingerprint,
+		Started:        conn.started,
+		Transfers:      make([]transferInfo, 0),
+	}
+	for _, p := range conn.activeTransfers() {
+		bytes := p.bytes.Load()
+		transfer := transferInfo{
+			Path:      p.path,
+			Direction: p.direction,
+			Size:      p.size,
+			Bytes:     bytes,
+			Started:   p.started,
+		}
+		if elapsed := time.Since(p.started).Seconds(); elapsed > 0 {
+			transfer.Rate = float64(bytes) / elapsed
+		}
+		info.Transfers = append(info.Transfers, transfer)
+	}
+	return info
+}
+
+func (c *scpConfig) initAdminAPI() error {
+	if len(c.AdminSocket) > 0 && len(c.AdminToken) == 0 {
+		return errors.New("An admin token is required to enable the admin API")
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+// Reject requests that don't carry our admin token
+func (config scpConfig) requireAdminToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(config.AdminToken)) != 1 {
+			writeError(w, http.StatusUnauthorized, "invalid admin token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (config scpConfig) handleSessions(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/sessions")
+	id = strings.TrimPrefix(id, "/")
+
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		sessions := make([]sessionInfo, 0)
+		for _, conn := range config.sessions.list() {
+			sessions = append(sessions, describeSession(conn))
+		}
+		writeJSON(w, http.StatusOK, sessions)
+	case r.Method == http.MethodDelete && id != "":
+		if !config.sessions.kill(id) {
+			writeError(w, http.StatusNotFound, "no such session")
+			return
+		}
+		slog.Info("Session killed through the admin API", "session", id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (config scpConfig) handleBans(w http.ResponseWriter, r *http.Request) {
+	ip := strings.TrimPrefix(r.URL.Path, "/bans")
+	ip = strings.TrimPrefix(ip, "/")
+
+	switch {
+	case r.Method == http.MethodGet && ip == "":
+		writeJSON(w, http.StatusOK, config.sessions.bans())
+	case r.Method == http.MethodPost && ip != "":
+		if net.ParseIP(ip) == nil {
+			writeError(w, http.StatusBadRequest, "invalid IP address")
+			return
+		}
+		config.sessions.ban(ip)
+		slog.Warn("IP banned through the admin API", "ip", ip)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodDelete && ip != "":
+		if !config.sessions.unban(ip) {
+			writeError(w, http.StatusNotFound, "IP is not banned")
+			return
+		}
+		slog.Info("IP unbanned through the admin API", "ip", ip)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// Serve the admin API on a unix socket only accessible by the user running the server
+func startAdminAPI(config *scpConfig) {
+	// A socket left behind by a previous run would make Listen fail, but anything else there isn't ours to remove
+	if fi, err := os.Lstat(config.AdminSocket); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			slog.Error("Admin API socket path exists and isn't a socket", "socket", config.AdminSocket)
+			return
+		}
+		os.Remove(config.AdminSocket)
+	}
+	listener, err := net.Listen("unix", config.AdminSocket)
+	if err != nil {
+		slog.Error("Unable to listen for admin API requests", "socket", config.AdminSocket, "err", err)
+		return
+	}
+	err = os.Chmod(config.AdminSocket, 0600)
+	if err != nil {
+		slog.Error("Unable to restrict access to admin API socket", "socket", config.AdminSocket, "err", err)
+		listener.Close()
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sessions", config.handleSessions)
+	mux.HandleFunc("/sessions/", config.handleSessions)
+	mux.HandleFunc("/bans", config.handleBans)
+	mux.HandleFunc("/bans/", config.handleBans)
+
+	slog.Info("Serving admin API", "socket", config.AdminSocket)
+	err = http.Serve(listener, config.requireAdminToken(mux))
+	if err != nil {
+		slog.Error("Admin API stopped", "err", err)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Value of SIMPLESCP_AUDITLOG that sends the audit log to syslog instead of a file
+const auditToSyslog = "syslog"
+
+// One line of the audit log, describing what happened with a file
+type auditRecord struct {
+	Time           time.Time         `json:"time"`
+	Session        string            `json:"session"`
+	User           string            `json:"user"`
+	KeyFingerprint string            `json:"key_fingerprint,omitempty"`
+	ClientIP       string            `json:"client_ip"`
+	Direction      string            `json:"direction"` // "upload" or "download"
+	Path           string            `json:"path"`
+	Size           int64             `json:"size"`
+	DurationMs     int64             `json:"duration_ms"`
+	Checksums      map[string]string `json:"checksums,omitempty"`
+	Result         string            `json:"result"` // "ok" or "error"
+	Error          string            `json:"error,omitempty"`
+}
+
+// Writes audit records as JSON lines. A nil auditLogger discards everything
+type auditLogger struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// Open the audit log as configured: a rotating file, syslog, or nothing at all
+func (c *scpConfig) initAuditLog() error {
+	switch c.AuditLog {
+	case "":
+		return nil
+	case auditToSyslog:
+		w, err := newSyslogWriter("simplescp-audit")
+		if err != nil {
+			return err
+		}
+		c.audit = &auditLogger{w: w}
+	default:
+		c.audit = &auditLogger{w: &lumberjack.Logger{
+			Filename:   c.AuditLog,
+			MaxSize:    c.AuditLogMaxSize,
+			MaxBackups: c.AuditLogMaxBackups,
+		}}
+	}
+	slog.Info("Writing audit log", "destination", c.AuditLog)
+	return nil
+}
+
+func (a *auditLogger) write(record auditRecord) {
+	if a == nil {
+		return
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		slog.Error("Unable to encode audit record", "err", err)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, err = a.w.Write(append(line, '\n'))
+	if err != nil {
+		slog.Error("Unable to write to audit log", "err", err)
+	}
+}
+
+// Record the outcome of transferring a file that started at start
+func (a *auditLogger) logTransfer(conn *connState, direction string, path string, size int64, start time.Time, sums map[string]string, err error) {
+	record := auditRecord{
+		Time:           time.Now().UTC(),
+		Session:        conn.sessionID,
+		User:           conn.user,
+		KeyFingerprint: conn.keyFingerprint,
+		ClientIP:       conn.clientIP(),
+		Direction:      direction,
+		Path:           path,
+		Size:           size,
+		DurationMs:     time.Since(start).Nanoseconds() / int64(time.Millisecond),
+		Checksums:      sums,
+		Result:         "ok",
+	}
+	if err != nil {
+		record.Result = "error"
+		record.Error = err.Error()
+	}
+	a.write(record)
+}
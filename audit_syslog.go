@@ -0,0 +1,12 @@
+// +build !windows
+
+package main
+
+import (
+	"io"
+	"log/syslog"
+)
+
+func newSyslogWriter(tag string) (io.Writer, error) {
+	return syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+}
@@ -0,0 +1,12 @@
+// +build windows
+
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+func newSyslogWriter(tag string) (io.Writer, error) {
+	return nil, errors.New("syslog is not available on windows")
+}
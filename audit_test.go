@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLogTransfer(t *testing.T) {
+	var buf bytes.Buffer
+	audit := &auditLogger{w: &buf}
+	conn := &connState{
+		sessionID:      "0123456789abcdef",
+		user:           "scpuser",
+		keyFingerprint: "SHA256:abc",
+		remoteAddr:     &net.TCPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 2222},
+	}
+	start := time.Now().Add(-1500 * time.Millisecond)
+	sums := map[string]string{"sha256": "deadbeef"}
+	audit.logTransfer(conn, "upload", "/srv/a", 10, start, sums, nil)
+	audit.logTransfer(conn, "download", "/srv/b", 3, start, nil, errors.New("broken pipe"))
+	// A nil logger doesn't write anywhere
+	(*auditLogger)(nil).logTransfer(conn, "upload", "/srv/c", 0, start, nil, nil)
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 records, got %q", buf.String())
+	}
+
+	var ok map[string]interface{}
+	err := json.Unmarshal(lines[0], &ok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"session":         "0123456789abcdef",
+		"user":            "scpuser",
+		"key_fingerprint": "SHA256:abc",
+		"client_ip":       "192.0.2.1",
+		"direction":       "upload",
+		"path":            "/srv/a",
+		"size":            float64(10),
+		"result":          "ok",
+	}
+	for field, value := range expected {
+		if ok[field] != value {
+			t.Errorf("%s: expected %v, got %v", field, value, ok[field])
+		}
+	}
+	if d, _ := ok["duration_ms"].(float64); d < 1500 {
+		t.Errorf("Expected a duration of at least 1500ms, got %v", ok["duration_ms"])
+	}
+	if _, err := time.Parse(time.RFC3339Nano, ok["time"].(string)); err != nil {
+		t.Errorf("Unexpected time %v: %v", ok["time"], err)
+	}
+	if sums, _ := ok["checksums"].(map[string]interface{}); sums["sha256"] != "deadbeef" {
+		t.Errorf("Unexpected checksums %v", ok["checksums"])
+	}
+	if _, found := ok["error"]; found {
+		t.Errorf("Expected no error field, got %v", ok["error"])
+	}
+
+	var failed auditRecord
+	err = json.Unmarshal(lines[1], &failed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failed.Result != "error" || failed.Error != "broken pipe" || failed.Checksums != nil || failed.Direction != "download" {
+		t.Errorf("Unexpected record for a failed transfer: %s", lines[1])
+	}
+}
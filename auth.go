@@ -3,41 +3,51 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"log/slog"
 
-	"github.com/FranGM/simplelog"
 	"golang.org/x/crypto/ssh"
 )
 
 func (c scpConfig) passwordAuth(conn ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
 	username := conn.User()
-	simplelog.Debug.Printf("Doing password authentication for user %v", username)
+	slog.Debug("Doing password authentication", "user", username, "remote_addr", conn.RemoteAddr())
 	// Consider using hashes for the comparison instead of a straight equality check
 	if username == c.User && string(pass) == c.passwords[username] {
-		simplelog.Info.Printf("Accepted password for %v", username)
+		slog.Info("Accepted password", "user", username, "remote_addr", conn.RemoteAddr())
 		return nil, nil
 	}
 
-	simplelog.Info.Printf("Rejected password for %v", username)
+	slog.Info("Rejected password", "user", username, "remote_addr", conn.RemoteAddr())
+	authAttempts.WithLabelValues("password", "failure").Inc()
 	return nil, fmt.Errorf("password rejected for %v", username)
 }
 
+// Permissions extension holding the fingerprint of the key a user authenticated with
+const keyFingerprintExtension = "pubkey-fp"
+
 func (c scpConfig) keyAuth(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
 	username := conn.User()
 
-	simplelog.Debug.Printf("authenticating with key of type %q", key.Type())
+	slog.Debug("Authenticating with key", "user", username, "remote_addr", conn.RemoteAddr(), "key_type", key.Type())
 
 	listKeys, ok := c.AuthKeys[username]
 	if !ok {
+		authAttempts.WithLabelValues("publickey", "failure").Inc()
 		return nil, fmt.Errorf("No keys for %q", username)
 	}
 
 	for _, authorizedKey := range listKeys {
 		if bytes.Compare(key.Marshal(), authorizedKey.Marshal()) == 0 {
-			simplelog.Info.Printf("Access granted for user %v", username)
-			return nil, nil
+			// The client still has to prove it holds the private key, so this only counts as a login
+			// once the handshake is done (see handleConn)
+			slog.Info("Accepted key", "user", username, "remote_addr", conn.RemoteAddr(), "key_fingerprint", ssh.FingerprintSHA256(key))
+			// Keep track of the key that was used, so we can tell later who did what
+			perms := &ssh.Permissions{Extensions: map[string]string{keyFingerprintExtension: ssh.FingerprintSHA256(key)}}
+			return perms, nil
 		}
 	}
 
-	simplelog.Info.Printf("Rejected key authentication for user %v", username)
+	slog.Info("Rejected key", "user", username, "remote_addr", conn.RemoteAddr(), "key_fingerprint", ssh.FingerprintSHA256(key))
+	authAttempts.WithLabelValues("publickey", "failure").Inc()
 	return nil, fmt.Errorf("key rejected for %v", username)
 }
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// Offers the public key of one signer, but signs with another one's private key
+type impostorSigner struct {
+	ssh.Signer
+	other ssh.Signer
+}
+
+func (s impostorSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return s.other.Sign(rand, data)
+}
+
+// Log into a server running with config, over a loopback connection
+func login(config *scpConfig, signer ssh.Signer) error {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serverConn, err := listener.Accept()
+		if err == nil {
+			config.handleConn(serverConn, config.initSSHConfig())
+		}
+	}()
+
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		return err
+	}
+	defer func() {
+		clientConn.Close()
+		<-done
+	}()
+
+	c, _, _, err := ssh.NewClientConn(clientConn, listener.Addr().String(), &ssh.ClientConfig{
+		User:            config.User,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		return err
+	}
+	return c.Close()
+}
+
+func TestKeyLoginMetrics(t *testing.T) {
+	key := newTestSigner(t)
+	config := newScpConfig()
+	config.privateKey = newTestSigner(t)
+	config.AuthKeys = map[string][]ssh.PublicKey{config.User: {key.PublicKey()}}
+	successes := authAttempts.WithLabelValues("publickey", "success")
+
+	// Knowing an authorized public key isn't enough to log in
+	before := testutil.ToFloat64(successes)
+	err := login(config, impostorSigner{key, newTestSigner(t)})
+	if err == nil {
+		t.Fatalf("Expected login without the private key to fail")
+	}
+	if got := testutil.ToFloat64(successes); got != before {
+		t.Errorf("Failed login counted as a success (%v successful logins, was %v)", got, before)
+	}
+
+	err = login(config, key)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if got := testutil.ToFloat64(successes); got != before+1 {
+		t.Errorf("Expected %v successful logins, got %v", before+1, got)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// Platforms the server is expected to build on, besides the one running the tests
+var crossPlatforms = []string{
+	"darwin/amd64",
+	"darwin/arm64",
+	"dragonfly/amd64",
+	"freebsd/amd64",
+	"netbsd/amd64",
+	"openbsd/amd64",
+	"solaris/amd64",
+	"windows/amd64",
+}
+
+// Platforms built by every run: windows has none of the unix code, and freebsd has the unix code with other syscalls than linux
+var defaultCrossPlatforms = []string{
+	"freebsd/amd64",
+	"windows/amd64",
+}
+
+// Building for every platform takes minutes, so the rest only get built with SIMPLESCP_CROSSBUILD=1
+func TestCrossCompile(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Cross compiling takes a while")
+	}
+	gobin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("No go toolchain available")
+	}
+
+	platforms := defaultCrossPlatforms
+	if os.Getenv("SIMPLESCP_CROSSBUILD") == "1" {
+		platforms = crossPlatforms
+	}
+	for _, platform := range platforms {
+		goos, goarch, _ := strings.Cut(platform, "/")
+		t.Run(platform, func(t *testing.T) {
+			// vet type checks the tests too, which build alone wouldn't
+			for _, args := range [][]string{{"build", "./..."}, {"vet", "./..."}} {
+				cmd := exec.Command(gobin, args...)
+				cmd.Env = append(os.Environ(), "GOOS="+goos, "GOARCH="+goarch, "CGO_ENABLED=0")
+				out, err := cmd.CombinedOutput()
+				if err != nil {
+					t.Fatalf("go %s: %v\n%s", args[0], err, out)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/cespare/xxhash/v2"
+	"golang.org/x/crypto/ssh"
+	"lukechampine.com/blake3"
+)
+
+// Hash algorithms we know how to compute, and the exec command that exposes each of them to clients
+var checksumCommands = map[string]string{
+	"sha256sum": "sha256",
+	"b3sum":     "blake3",
+	"xxh64sum":  "xxhash",
+}
+
+func newHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case "sha256":
+		return sha256.New(), nil
+	case "blake3":
+		return blake3.New(32, nil), nil
+	case "xxhash":
+		return xxhash.New(), nil
+	}
+	return nil, fmt.Errorf("Unknown checksum algorithm %q", algorithm)
+}
+
+// Make sure the optional checksum algorithm is one we support
+func (c *scpConfig) initChecksums() error {
+	if len(c.ExtraChecksum) == 0 {
+		return nil
+	}
+	_, err := newHash(c.ExtraChecksum)
+	return err
+}
+
+// Checksums computed on the fly while a file is being transferred
+type transferHashes map[string]hash.Hash
+
+// SHA-256 is always computed, plus the configured extra algorithm if there's one
+func (config scpConfig) newTransferHashes() transferHashes {
+	hashes := transferHashes{"sha256": sha256.New()}
+	if len(config.ExtraChecksum) > 0 {
+		// Validated on startup, so this can't fail
+		h, _ := newHash(config.ExtraChecksum)
+		hashes[config.ExtraChecksum] = h
+	}
+	return hashes
+}
+
+// Writer that feeds everything written to it to all the hashes
+func (t transferHashes) writer() io.Writer {
+	writers := make([]io.Writer, 0, len(t))
+	for _, h := range t {
+		writers = append(writers, h)
+	}
+	return io.MultiWriter(writers...)
+}
+
+// Hex encoded checksums, indexed by algorithm
+func (t transferHashes) sums() map[string]string {
+	sums := make(map[string]string)
+	for algorithm, h := range t {
+		sums[algorithm] = hex.EncodeToString(h.Sum(nil))
+	}
+	return sums
+}
+
+// Human readable list of checksums, for logging purposes
+func (t transferHashes) String() string {
+	sums := t.sums()
+	algorithms := make([]string, 0, len(sums))
+	for algorithm := range sums {
+		algorithms = append(algorithms, algorithm)
+	}
+	sort.Strings(algorithms)
+
+	parts := make([]string, 0, len(algorithms))
+	for _, algorithm := range algorithms {
+		parts = append(parts, algorithm+":"+sums[algorithm])
+	}
+	return strings.Join(parts, " ")
+}
+
+// Compute the checksum of a file
+func fileChecksum(filename string, algorithm string) (string, error) {
+	h, err := newHash(algorithm)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Run one of the checksum commands (like "sha256sum <path>...") and return the exit status for the client.
+// Output mimics coreutils, and only files inside our shared directory can be checked.
+func (config scpConfig) handleChecksumCommand(channel ssh.Channel, command string, targets []string) uint8 {
+	var exitStatus uint8
+	if len(targets) == 0 {
+		fmt.Fprintf(channel.Stderr(), "usage: %s <path>...\n", command)
+		return 1
+	}
+
+	for _, target := range targets {
+		filename, err := config.jailedPath(target)
+		var sum string
+		if err == nil {
+			sum, err = fileChecksum(filename, checksumCommands[command])
+		}
+		if err != nil {
+			slog.Error("Checksum command failed", "command", command, "target", target, "err", err)
+			var pathErr *os.PathError
+			if errors.As(err, &pathErr) {
+				err = fmt.Errorf("%s: %v", target, pathErr.Err)
+			}
+			fmt.Fprintf(channel.Stderr(), "%s: %v\n", command, err)
+			exitStatus = 1
+			continue
+		}
+		fmt.Fprintf(channel, "%s  %s\n", sum, target)
+	}
+	return exitStatus
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// sha256sum of "hello\n"
+const helloSHA256 = "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03"
+
+// ssh.Channel that keeps everything written to it and to its stderr
+type recordingChannel struct {
+	discardChannel
+	stdout bytes.Buffer
+	stderr bytes.Buffer
+}
+
+func (c *recordingChannel) Write(data []byte) (int, error) {
+	return c.stdout.Write(data)
+}
+
+func (c *recordingChannel) Stderr() io.ReadWriter {
+	return &c.stderr
+}
+
+func TestNewHash(t *testing.T) {
+	for _, algorithm := range checksumCommands {
+		if _, err := newHash(algorithm); err != nil {
+			t.Errorf("%s: %v", algorithm, err)
+		}
+	}
+	if _, err := newHash("md5"); err == nil {
+		t.Errorf("Expected an error for an unknown algorithm")
+	}
+	if err := (&scpConfig{ExtraChecksum: "crc32"}).initChecksums(); err == nil {
+		t.Errorf("Expected an error configuring an unknown algorithm")
+	}
+}
+
+func TestTransferHashes(t *testing.T) {
+	hashes := scpConfig{ExtraChecksum: "xxhash"}.newTransferHashes()
+	io.WriteString(hashes.writer(), "hello\n")
+	sums := hashes.sums()
+	if len(sums) != 2 || sums["sha256"] != helloSHA256 || len(sums["xxhash"]) != 16 {
+		t.Errorf("Unexpected checksums %v", sums)
+	}
+}
+
+func TestChecksumCommand(t *testing.T) {
+	config := scpConfig{Dir: t.TempDir()}
+	err := os.Mkdir(filepath.Join(config.Dir, "sub"), 0755)
+	if err == nil {
+		err = os.WriteFile(filepath.Join(config.Dir, "sub", "hello"), []byte("hello\n"), 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	channel := &recordingChannel{}
+	status := config.handleChecksumCommand(channel, "sha256sum", []string{"sub/hello"})
+	if status != 0 || channel.stdout.String() != helloSHA256+"  sub/hello\n" || channel.stderr.Len() > 0 {
+		t.Errorf("Got status %d, output %q and errors %q", status, channel.stdout.String(), channel.stderr.String())
+	}
+
+	// Files that can't be checked are reported, but don't stop the rest from being checked
+	channel = &recordingChannel{}
+	status = config.handleChecksumCommand(channel, "sha256sum", []string{"missing", "../../etc/passwd", "sub", "sub/hello"})
+	if status != 1 || channel.stdout.String() != helloSHA256+"  sub/hello\n" {
+		t.Errorf("Got status %d and output %q", status, channel.stdout.String())
+	}
+	messages := strings.Split(strings.TrimSpace(channel.stderr.String()), "\n")
+	expected := []string{
+		"sha256sum: missing: no such file or directory",
+		"sha256sum: ../../etc/passwd: no such file or directory",
+		"sha256sum: sub: is a directory",
+	}
+	if len(messages) != len(expected) {
+		t.Fatalf("Expected errors %q, got %q", expected, messages)
+	}
+	for i := range expected {
+		if messages[i] != expected[i] {
+			t.Errorf("Expected error %q, got %q", expected[i], messages[i])
+		}
+	}
+
+	channel = &recordingChannel{}
+	status = config.handleChecksumCommand(channel, "b3sum", nil)
+	if status != 1 || !strings.HasPrefix(channel.stderr.String(), "usage: b3sum") {
+		t.Errorf("Got status %d and errors %q", status, channel.stderr.String())
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+
+	"github.com/FranGM/simplescp/scp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Copy files from or to another scp server, instead of being one:
+//
+//	simplescp get [options] [user@]host:path... target
+//	simplescp put [options] source... [user@]host:path
+//
+// Authenticates with the key given with -i, or with the password in SIMPLESCP_PASS
+func clientMain(command string, args []string) int {
+	flags := flag.NewFlagSet("simplescp "+command, flag.ContinueOnError)
+	var opts scp.Options
+	flags.BoolVar(&opts.Recursive, "r", false, "Copy directories recursively")
+	flags.BoolVar(&opts.Preserve, "p", false, "Preserve modes and times")
+	port := flags.String("P", "22", "Port of the server")
+	keyFile := flags.String("i", "", "Private key to authenticate with")
+	knownHostsFile := flags.String("known-hosts", "", "Known hosts file to check the server's key against. Default: ~/.ssh/known_hosts")
+	insecure := flags.Bool("insecure", false, "Don't check the server's key")
+	flags.Usage = func() {
+		if command == "get" {
+			fmt.Fprintln(flags.Output(), "Usage: simplescp get [options] [user@]host:path... target")
+		} else {
+			fmt.Fprintln(flags.Output(), "Usage: simplescp put [options] source... [user@]host:path")
+		}
+		flags.PrintDefaults()
+	}
+	if flags.Parse(args) != nil {
+		return 2
+	}
+	if flags.NArg() < 2 {
+		flags.Usage()
+		return 2
+	}
+
+	srcs := flags.Args()[:flags.NArg()-1]
+	dst := flags.Arg(flags.NArg() - 1)
+	remotes := srcs
+	if command == "put" {
+		remotes = []string{dst}
+	}
+
+	userHost, err := remoteHost(remotes)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "simplescp: %v\n", err)
+		return 2
+	}
+
+	clientConfig, err := newClientConfig(userHost, *keyFile, *knownHostsFile, *insecure)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "simplescp: %v\n", err)
+		return 1
+	}
+	host := userHost[strings.LastIndexByte(userHost, '@')+1:]
+	client, err := ssh.Dial("tcp", net.JoinHostPort(host, *port), clientConfig)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "simplescp: %v\n", err)
+		return 1
+	}
+	defer client.Close()
+
+	err = scp.Copy(client, srcs, dst, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "simplescp: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// All remote paths of a copy have to be on the same server, since we only connect to one
+func remoteHost(paths []string) (string, error) {
+	var userHost string
+	for _, path := range paths {
+		host, _, ok := scp.RemotePath(path)
+		if !ok || len(host) == 0 {
+			return "", fmt.Errorf("%s: not a remote path ([user@]host:path)", path)
+		}
+		if len(userHost) > 0 && host != userHost {
+			return "", fmt.Errorf("%s: all remote paths have to be on %s", path, userHost)
+		}
+		userHost = host
+	}
+	return userHost, nil
+}
+
+func newClientConfig(userHost string, keyFile string, knownHostsFile string, insecure bool) (*ssh.ClientConfig, error) {
+	config := &ssh.ClientConfig{}
+
+	if i := strings.LastIndexByte(userHost, '@'); i >= 0 {
+		config.User = userHost[:i]
+	} else {
+		u, err := user.Current()
+		if err != nil {
+			return nil, err
+		}
+		config.User = u.Username
+	}
+
+	if len(keyFile) > 0 {
+		pemBytes, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(pemBytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", keyFile, err)
+		}
+		config.Auth = append(config.Auth, ssh.PublicKeys(signer))
+	}
+	if pass := os.Getenv("SIMPLESCP_PASS"); len(pass) > 0 {
+		config.Auth = append(config.Auth, ssh.Password(pass))
+	}
+	if len(config.Auth) == 0 {
+		return nil, errors.New("no way to authenticate, use -i or set SIMPLESCP_PASS")
+	}
+
+	if insecure {
+		config.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+		return config, nil
+	}
+	if len(knownHostsFile) == 0 {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	callback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, err
+	}
+	config.HostKeyCallback = callback
+	return config, nil
+}
@@ -0,0 +1,10 @@
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris,!windows
+
+package main
+
+import "errors"
+
+// No way to tell here, so uploads get rejected if a minimum free space is configured
+func getFreeSpace(path string) (uint64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,15 @@
+// +build aix darwin dragonfly freebsd linux
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// Bytes available to unprivileged users in the filesystem containing path
+func getFreeSpace(path string) (uint64, error) {
+	var stat unix.Statfs_t
+	err := unix.Statfs(path, &stat)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,15 @@
+// +build netbsd solaris
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// Bytes available to unprivileged users in the filesystem containing path
+func getFreeSpace(path string) (uint64, error) {
+	var stat unix.Statvfs_t
+	err := unix.Statvfs(path, &stat)
+	if err != nil {
+		return 0, err
+	}
+	return stat.Bavail * stat.Frsize, nil
+}
@@ -0,0 +1,19 @@
+// +build windows
+
+package main
+
+import "golang.org/x/sys/windows"
+
+// Bytes available to the user we run as in the volume containing path
+func getFreeSpace(path string) (uint64, error) {
+	dir, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	var free, total, totalFree uint64
+	err = windows.GetDiskFreeSpaceEx(dir, &free, &total, &totalFree)
+	if err != nil {
+		return 0, err
+	}
+	return free, nil
+}
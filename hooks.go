@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flynn/go-shlex"
+)
+
+// Events that can trigger a hook
+const (
+	eventLogin        = "login"
+	eventLogout       = "logout"
+	eventPostUpload   = "post-upload"
+	eventPostDownload = "post-download"
+)
+
+// What hooks get told about an event. Commands get it as JSON on their stdin, URLs as a POST body
+type hookEvent struct {
+	Event     string            `json:"event"`
+	Time      time.Time         `json:"time"`
+	Session   string            `json:"session"`
+	User      string            `json:"user"`
+	ClientIP  string            `json:"client_ip"`
+	Path      string            `json:"path,omitempty"`
+	Size      int64             `json:"size,omitempty"`
+	Checksums map[string]string `json:"checksums,omitempty"`
+}
+
+func newHookEvent(event string, conn *connState) hookEvent {
+	return hookEvent{
+		Event:    event,
+		Time:     time.Now().UTC(),
+		Session:  conn.sessionID,
+		User:     conn.user,
+		ClientIP: conn.clientIP(),
+	}
+}
+
+// Hook configured for an event, if any
+func (config scpConfig) hookFor(event string) string {
+	switch event {
+	case eventLogin:
+		return config.HookLogin
+	case eventLogout:
+		return config.HookLogout
+	case eventPostUpload:
+		return config.HookPostUpload
+	case eventPostDownload:
+		return config.HookPostDownload
+	}
+	return ""
+}
+
+// How long to wait before retrying a failed hook, multiplied by the number of attempts made so far
+var hookRetryDelay = time.Second
+
+func isURLHook(hook string) bool {
+	return strings.HasPrefix(hook, "http://") || strings.HasPrefix(hook, "https://")
+}
+
+// Run the hook for event in the background, retrying if it fails
+func (config scpConfig) fireHook(conn *connState, event hookEvent) {
+	hook := config.hookFor(event.Event)
+	if len(hook) == 0 {
+		return
+	}
+
+	go func() {
+		payload, err := json.Marshal(event)
+		if err != nil {
+			conn.log.Error("Unable to encode hook event", "event", event.Event, "err", err)
+			return
+		}
+
+		for attempt := 0; attempt <= config.HookRetries; attempt++ {
+			if attempt > 0 {
+				time.Sleep(time.Duration(attempt) * hookRetryDelay)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), config.HookTimeout)
+			if isURLHook(hook) {
+				err = postHook(ctx, hook, payload)
+			} else {
+				err = runCommandHook(ctx, hook, event, payload)
+			}
+			cancel()
+			if err == nil {
+				conn.log.Debug("Ran hook", "event", event.Event, "hook", hook)
+				return
+			}
+			conn.log.Warn("Hook failed", "event", event.Event, "hook", hook, "attempt", attempt+1, "err", err)
+		}
+		conn.log.Error("Giving up on hook", "event", event.Event, "hook", hook)
+	}()
+}
+
+// POST the event to url, anything other than a 2xx response counts as a failure
+func postHook(ctx context.Context, url string, payload []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("got HTTP status %v", resp.Status)
+	}
+	return nil
+}
+
+// Environment for hook commands: ours, minus our own configuration (which includes passwords and tokens),
+// plus the event in SIMPLESCP_EVENT_* variables
+func hookEnv(event hookEvent) []string {
+	var env []string
+	for _, v := range os.Environ() {
+		if !strings.HasPrefix(v, "SIMPLESCP_") {
+			env = append(env, v)
+		}
+	}
+	return append(env,
+		"SIMPLESCP_EVENT_TYPE="+event.Event,
+		"SIMPLESCP_EVENT_SESSION="+event.Session,
+		"SIMPLESCP_EVENT_USER="+event.User,
+		"SIMPLESCP_EVENT_CLIENT_IP="+event.ClientIP,
+		"SIMPLESCP_EVENT_PATH="+event.Path,
+		"SIMPLESCP_EVENT_SIZE="+strconv.FormatInt(event.Size, 10),
+		"SIMPLESCP_EVENT_SHA256="+event.Checksums["sha256"],
+	)
+}
+
+// Run command (no shell involved), passing it the event as JSON on stdin and in SIMPLESCP_EVENT_* environment variables
+func runCommandHook(ctx context.Context, command string, event hookEvent, payload []byte) error {
+	args, err := shlex.Split(command)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("empty hook command")
+	}
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Env = hookEnv(event)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
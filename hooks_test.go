@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Hook server counting the requests it gets, which fails the first few of them
+func newHookServer(failures int32) (*httptest.Server, *atomic.Int32) {
+	var attempts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	return server, &attempts
+}
+
+// Wait until attempts gets to n, and a bit longer to make sure it doesn't go past it
+func waitForAttempts(t *testing.T, attempts *atomic.Int32, n int32) {
+	deadline := time.Now().Add(5 * time.Second)
+	for attempts.Load() < n && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := attempts.Load(); got != n {
+		t.Errorf("Expected %d attempts, got %d", n, got)
+	}
+}
+
+func TestHookRetries(t *testing.T) {
+	defer func(delay time.Duration) { hookRetryDelay = delay }(hookRetryDelay)
+	hookRetryDelay = time.Millisecond
+	conn := &connState{user: "scpuser", remoteAddr: &net.TCPAddr{IP: net.IPv6loopback}, log: slog.Default()}
+
+	// Retried until it works...
+	server, attempts := newHookServer(2)
+	defer server.Close()
+	config := scpConfig{HookLogin: server.URL, HookTimeout: time.Second, HookRetries: 5}
+	config.fireHook(conn, newHookEvent(eventLogin, conn))
+	waitForAttempts(t, attempts, 3)
+
+	// ...or until we run out of retries
+	server, attempts = newHookServer(100)
+	defer server.Close()
+	config = scpConfig{HookLogout: server.URL, HookTimeout: time.Second, HookRetries: 2}
+	config.fireHook(conn, newHookEvent(eventLogout, conn))
+	waitForAttempts(t, attempts, 3)
+
+	// Events without a hook don't go anywhere
+	config.fireHook(conn, newHookEvent(eventLogin, conn))
+	waitForAttempts(t, attempts, 3)
+}
+
+func TestHookTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := postHook(ctx, server.URL, nil); err == nil {
+		t.Errorf("Expected a hook that doesn't answer to time out")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Hook took %v to time out", elapsed)
+	}
+
+	if _, err := exec.LookPath("sleep"); err != nil {
+		t.Skip("No sleep command to run as a hook")
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	if err := runCommandHook(ctx, "sleep 10", hookEvent{}, nil); err == nil {
+		t.Errorf("Expected a hook command that doesn't finish to time out")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Hook command took %v to time out", elapsed)
+	}
+}
+
+func TestHookCommandEnv(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("No shell to run as a hook")
+	}
+	t.Setenv("SIMPLESCP_PASS", "hunter2")
+	t.Setenv("SIMPLESCP_ADMINTOKEN", "hunter3")
+	out := filepath.Join(t.TempDir(), "env")
+	event := hookEvent{Event: eventPostUpload, Session: "0123456789abcdef", User: "scpuser", ClientIP: "192.0.2.1",
+		Path: "/srv/a", Size: 10, Checksums: map[string]string{"sha256": "deadbeef"}}
+
+	err := runCommandHook(context.Background(), "sh -c 'env > "+out+"'", event, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := string(data)
+	if strings.Contains(env, "hunter") {
+		t.Errorf("Expected our configuration to be kept from hooks, got %s", env)
+	}
+	for _, v := range []string{"SIMPLESCP_EVENT_TYPE=post-upload", "SIMPLESCP_EVENT_SESSION=0123456789abcdef", "SIMPLESCP_EVENT_USER=scpuser",
+		"SIMPLESCP_EVENT_CLIENT_IP=192.0.2.1", "SIMPLESCP_EVENT_PATH=/srv/a", "SIMPLESCP_EVENT_SIZE=10", "SIMPLESCP_EVENT_SHA256=deadbeef"} {
+		if !strings.Contains(env, v+"\n") {
+			t.Errorf("Expected %s in the environment, got %s", v, env)
+		}
+	}
+}
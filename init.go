@@ -7,13 +7,15 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"log/slog"
 	"math/big"
 	"os"
 	"unicode"
 
-	"github.com/FranGM/simplelog"
 	"github.com/kelseyhightower/envconfig"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+	"golang.org/x/time/rate"
 )
 
 // Generates a random string of length n (http://play.golang.org/p/1GwSRsKIsd)
@@ -41,7 +43,20 @@ func (c *scpConfig) initPassword() error {
 	// TODO: This doesn't allow for setting the password to ""
 	if len(scpPasswd) == 0 {
 		scpPasswd = randString(15)
-		simplelog.Info.Printf("Generating random password for user %v: %q", c.User, scpPasswd)
+		slog.Info("Generated random password", "user", c.User, "password", secret(scpPasswd))
+		switch {
+		case len(c.PasswordFile) > 0:
+			err := os.WriteFile(c.PasswordFile, []byte(scpPasswd+"\n"), 0600)
+			if err != nil {
+				return fmt.Errorf("Can't write password file: %v", err)
+			}
+			slog.Info("Wrote generated password", "file", c.PasswordFile)
+		case term.IsTerminal(int(os.Stderr.Fd())):
+			// Logs can go to the same terminal, but nowhere else
+			fmt.Fprintf(os.Stderr, "Generated random password for user %v: %v\n", c.User, scpPasswd)
+		default:
+			slog.Warn("Not showing the generated password outside of a terminal, set SIMPLESCP_PASS or SIMPLESCP_PASSWORDFILE to log in with one")
+		}
 	}
 
 	c.passwords[c.User] = scpPasswd
@@ -68,26 +83,38 @@ func (c *scpConfig) initAuthKeys() error {
 	for scanner.Scan() {
 		pk, err := parsePubKey(scanner.Text())
 		if err != nil {
-			simplelog.Warning.Printf("Error when parsing public key, ignoring: %q", err)
+			slog.Warn("Error when parsing public key, ignoring", "err", err)
 			continue
 		}
 		c.AuthKeys[c.User] = append(c.AuthKeys[c.User], pk)
 	}
 
-	simplelog.Info.Printf("loaded %d authorized keys", len(c.AuthKeys[c.User]))
+	slog.Info("Loaded authorized keys", "count", len(c.AuthKeys[c.User]))
 	return nil
 }
 
+// Create the token buckets used to throttle transfers
+func (c *scpConfig) initRateLimits() {
+	c.globalLimiter = newBandwidthLimiter(c.RateLimit)
+	c.userLimiters = make(map[string]*rate.Limiter)
+	for user, kbits := range c.UserRateLimits {
+		c.userLimiters[user] = newBandwidthLimiter(kbits)
+	}
+	if c.globalLimiter != nil || len(c.UserRateLimits) > 0 || c.ConnRateLimit > 0 {
+		slog.Info("Bandwidth limits (Kbit/s)", "global", c.RateLimit, "per_user", c.UserRateLimits, "per_connection", c.ConnRateLimit)
+	}
+}
+
 func (c *scpConfig) initPrivateKey() error {
 	privateBytes, err := ioutil.ReadFile(c.PrivateKeyFile)
 	if err != nil {
 		if len(c.PrivateKeyFile) > 0 {
 			return fmt.Errorf("Can't load private key: %v", err)
 		}
-		simplelog.Debug.Printf("Generating random private key...")
+		slog.Debug("Generating random private key")
 		key, _ := rsa.GenerateKey(rand.Reader, 2048)
 		c.privateKey, _ = ssh.NewSignerFromKey(key)
-		simplelog.Debug.Printf("Done")
+		slog.Debug("Done generating random private key")
 	} else {
 		c.privateKey, err = ssh.ParsePrivateKey(privateBytes)
 		if err != nil {
@@ -104,23 +131,114 @@ func (c *scpConfig) initPrivateKey() error {
 //   SIMPLESCP_PORT: Port we'll be listening in. Default: 2222
 //   SIMPLESCP_USER: Username for connecting to this server. Default: scpuser
 //   SIMPLESCP_PASS: Password used for connecting to this server. Default: One will be generated randomly
+//   SIMPLESCP_PASSWORDFILE: File to write the generated password to (readable only by us). Default: Show it on stderr
+//     if it's a terminal
 //   SIMPLESCP_PRIVATEKEYFILE: Location for the private key that will identify this server. Default: One will be generated randomly
 //   SIMPLESCP_AUTHKEYSFILE: Location of the authorized keys file for this server. Default: No pubkey authentication
+//   SIMPLESCP_RATELIMIT: Bandwidth limit in Kbit/s shared by all transfers. Default: 0 (unlimited)
+//   SIMPLESCP_USERRATELIMITS: Per user bandwidth limits in Kbit/s, as "user1:limit1,user2:limit2". Default: None
+//   SIMPLESCP_CONNRATELIMIT: Bandwidth limit in Kbit/s for each connection. Default: 0 (unlimited)
+//   SIMPLESCP_QUOTABYTES: Limit of bytes stored in each user's root, past which uploads are rejected. Default: 0 (no limit)
+//   SIMPLESCP_QUOTAFILES: Limit of files stored in each user's root, past which uploads are rejected. Default: 0 (no limit)
+//   SIMPLESCP_USERQUOTABYTES: Per user limit of bytes stored, as "user1:bytes1,user2:bytes2". Default: SIMPLESCP_QUOTABYTES
+//   SIMPLESCP_USERQUOTAFILES: Per user limit of number of files stored, as "user1:files1,user2:files2". Default: SIMPLESCP_QUOTAFILES
+//   SIMPLESCP_MINFREESPACE: Bytes that must remain free in the filesystem after an upload. Default: 0 (no check)
+//   SIMPLESCP_MAXFILESIZE: Maximum size in bytes of an uploaded file. Default: 0 (no limit)
+//   SIMPLESCP_ALLOWEDFILES: Comma separated globs or extensions that uploads must match (e.g. "*.csv,.txt"). Default: Allow everything
+//   SIMPLESCP_DENIEDFILES: Comma separated globs or extensions that uploads can't match (e.g. "*.exe"). Default: Deny nothing
+//   SIMPLESCP_OVERWRITEPOLICY: What to do when uploading to an existing file: overwrite, refuse, rename or version. Default: overwrite
+//   SIMPLESCP_USEROVERWRITEPOLICIES: Per user overwrite policies, as "user1:policy1,user2:policy2". Default: None
+//   SIMPLESCP_RESUMABLEUPLOADS: Keep interrupted uploads, and accept simplescp-resume to resume them (and downloads).
+//     Default: false
+//   SIMPLESCP_PARTIALMAXAGE: How long to keep interrupted uploads around, checked on startup. Default: 168h
+//   SIMPLESCP_EXTRACHECKSUM: Checksum to compute on transfers besides SHA-256: blake3 or xxhash. Default: None
+//   SIMPLESCP_MANIFEST: Write a manifest into each directory uploaded recursively: sha256 or json. Default: None
+//   SIMPLESCP_AUDITLOG: File to write a JSON lines audit log of every transfer to, or "syslog". Default: No audit log
+//   SIMPLESCP_AUDITLOGMAXSIZE: Size in megabytes at which the audit log file is rotated. Default: 100
+//   SIMPLESCP_AUDITLOGMAXBACKUPS: Number of rotated audit log files to keep. Default: 5
+//   SIMPLESCP_LOGLEVEL: Minimum level of the messages logged: debug, info, warn or error. Default: info
+//   SIMPLESCP_LOGFORMAT: Format of the logs: text or json. Default: text
+//   SIMPLESCP_ADMINADDR: Address to serve /metrics, /healthz and /readyz on (like ":9100"). Default: Disabled
+//   SIMPLESCP_SHUTDOWNDELAY: Time to keep accepting connections after being asked to stop, while readiness fails. Default: 0s
+//   SIMPLESCP_SHUTDOWNTIMEOUT: Time to wait for open connections to finish when stopping. Default: 30s
+//   SIMPLESCP_ADMINSOCKET: Unix socket to serve the admin API (sessions and bans) on. Default: Disabled
+//   SIMPLESCP_ADMINTOKEN: Bearer token required by the admin API. Required if SIMPLESCP_ADMINSOCKET is set
+//   SIMPLESCP_HOOKLOGIN, SIMPLESCP_HOOKLOGOUT, SIMPLESCP_HOOKPOSTUPLOAD, SIMPLESCP_HOOKPOSTDOWNLOAD: Command to run,
+//     or http(s) URL to POST to, with a JSON description of the event. Commands also get it in SIMPLESCP_EVENT_TYPE,
+//     SIMPLESCP_EVENT_SESSION, SIMPLESCP_EVENT_USER, SIMPLESCP_EVENT_CLIENT_IP, SIMPLESCP_EVENT_PATH, SIMPLESCP_EVENT_SIZE
+//     and SIMPLESCP_EVENT_SHA256, but none of the other SIMPLESCP_* variables. Default: None
+//   SIMPLESCP_HOOKTIMEOUT: Time each attempt of running a hook can take. Default: 10s
+//   SIMPLESCP_HOOKRETRIES: Number of times a failed hook is retried. Default: 3
+//   SIMPLESCP_EVENTSPOOL: Directory (one JSON file per event) or named pipe (one JSON line per event) to report
+//     completed uploads to. Default: None
+//   SIMPLESCP_UMASK: Permissions (in octal) removed from the modes clients give uploaded files and directories.
+//     Setuid, setgid and sticky bits are always removed. Default: 022
+//   SIMPLESCP_USERFILEMODES: Per user modes forced on uploaded files, as "user1:0640,user2:0600". Default: None
+//   SIMPLESCP_USERDIRMODES: Per user modes forced on uploaded directories, as "user1:0750,user2:0700". Default: None
+//   SIMPLESCP_UPLOADOWNER: User (name or uid) to change the owner of uploads to. Default: Leave as is
+//   SIMPLESCP_UPLOADGROUP: Group (name or gid) to change the group of uploads to. Default: Leave as is
 func initSettings() *scpConfig {
 
 	// TODO: workingDir should be configurable
-	simplelog.SetThreshold(simplelog.LevelInfo)
-
 	config := newScpConfig()
 	err := envconfig.Process("simplescp", config)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	simplelog.Info.Printf("Allowing logins from user %q", config.User)
-	simplelog.Info.Printf("Sharing files out of %q", config.Dir)
+	err = config.initLogging()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	slog.Info("Allowing logins", "user", config.User)
+	slog.Info("Sharing files", "dir", config.Dir)
+
+	err = cleanupTempFiles(config.Dir, config.PartialMaxAge)
+	if err != nil {
+		slog.Error("Error cleaning up stale uploads", "err", err)
+	}
+
+	err = config.initOverwritePolicies()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = config.initChecksums()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = config.initUploadPermissions()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = validateManifestFormat(config.Manifest)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = config.initAuditLog()
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	config.initPassword()
+	err = config.initEventSpool()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = config.initAdminAPI()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = config.initPassword()
+	if err != nil {
+		log.Fatal(err)
+	}
+	config.initRateLimits()
 
 	err = config.initPrivateKey()
 	if err != nil {
@@ -129,7 +247,7 @@ func initSettings() *scpConfig {
 
 	err = config.initAuthKeys()
 	if err != nil {
-		simplelog.Error.Printf("%v", err)
+		slog.Error("Error loading authorized keys", "err", err)
 	}
 	return config
 
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Attribute keys whose values are never written to the logs
+var redactedLogKeys = map[string]bool{
+	"password": true,
+	"pass":     true,
+	"secret":   true,
+}
+
+// A value that shouldn't end up in the logs, whatever key it's logged under
+type secret string
+
+func (secret) LogValue() slog.Value {
+	return slog.StringValue("[REDACTED]")
+}
+
+func redactSecrets(groups []string, a slog.Attr) slog.Attr {
+	if redactedLogKeys[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, "[REDACTED]")
+	}
+	return a
+}
+
+func parseLogLevel(level string) (slog.Level, error) {
+	var l slog.Level
+	err := l.UnmarshalText([]byte(level))
+	if err != nil {
+		return l, fmt.Errorf("Unknown log level %q", level)
+	}
+	return l, nil
+}
+
+// Set up the default logger with the configured level and format (text or json)
+func (c *scpConfig) initLogging() error {
+	level, err := parseLogLevel(c.LogLevel)
+	if err != nil {
+		return err
+	}
+
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: redactSecrets}
+	var handler slog.Handler
+	switch strings.ToLower(c.LogFormat) {
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("Unknown log format %q", c.LogFormat)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// Log an error and exit
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
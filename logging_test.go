@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/FranGM/simplescp/scp"
+)
+
+func TestRedactSecrets(t *testing.T) {
+	var buf bytes.Buffer
+	log := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{ReplaceAttr: redactSecrets}))
+	log.Info("Logging in", "user", "scpuser", "password", "hunter2", "PASS", "hunter3", "Secret", "hunter4", "generated", secret("hunter5"))
+
+	out := buf.String()
+	if strings.Contains(out, "hunter") {
+		t.Errorf("Expected every secret to be redacted, got %s", out)
+	}
+	if !strings.Contains(out, `"user":"scpuser"`) || strings.Count(out, `"[REDACTED]"`) != 4 {
+		t.Errorf("Expected everything else to be logged as is, got %s", out)
+	}
+}
+
+func TestInitLogging(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+
+	tests := []struct {
+		level  string
+		format string
+		valid  bool
+		debug  bool
+	}{
+		{"info", "text", true, false},
+		{"DEBUG", "JSON", true, true},
+		{"warn", "json", true, false},
+		{"error", "text", true, false},
+		{"verbose", "text", false, false},
+		{"info", "xml", false, false},
+		{"", "text", false, false},
+	}
+	for _, test := range tests {
+		config := scpConfig{LogLevel: test.level, LogFormat: test.format}
+		err := config.initLogging()
+		if test.valid != (err == nil) {
+			t.Errorf("%s/%s: expected valid=%v, got %v", test.level, test.format, test.valid, err)
+			continue
+		}
+		if test.valid && slog.Default().Enabled(context.Background(), slog.LevelDebug) != test.debug {
+			t.Errorf("%s/%s: expected debug logging to be %v", test.level, test.format, test.debug)
+		}
+	}
+}
+
+func TestReportClientErrorLogsToSession(t *testing.T) {
+	var buf bytes.Buffer
+	log := slog.New(slog.NewTextHandler(&buf, nil)).With("session", "0123456789abcdef")
+	reportClientError(&scp.RemoteError{Msg: "scp: file: Permission denied"}, log)
+	if !strings.Contains(buf.String(), "session=0123456789abcdef") {
+		t.Errorf("Expected the error to be logged with the session, got %q", buf.String())
+	}
+}
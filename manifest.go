@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Formats available for the manifests written after a recursive upload
+const (
+	manifestSHA256 = "sha256" // MANIFEST.sha256, in the same format as sha256sum's output
+	manifestJSON   = "json"   // MANIFEST.json, with sizes, modes, mtimes and checksums
+)
+
+// Details about a file that was successfully received
+type receivedFile struct {
+	path  string // Where the file ended up being stored
+	size  int64
+	mode  os.FileMode
+	mtime time.Time // Only set if the client sent it
+	sums  map[string]string
+}
+
+type manifestEntry struct {
+	Path      string            `json:"path"`
+	Type      string            `json:"type"`
+	Size      int64             `json:"size"`
+	Mode      string            `json:"mode"`
+	Mtime     int64             `json:"mtime,omitempty"`
+	Checksums map[string]string `json:"checksums,omitempty"`
+}
+
+// Everything received under a directory uploaded recursively
+type manifest struct {
+	root    string
+	entries []manifestEntry
+}
+
+func validateManifestFormat(format string) error {
+	switch format {
+	case "", manifestSHA256, manifestJSON:
+		return nil
+	}
+	return fmt.Errorf("Unknown manifest format %q", format)
+}
+
+func (m *manifest) relPath(path string) string {
+	rel, err := filepath.Rel(m.root, path)
+	if err != nil {
+		return path
+	}
+	return filepath.ToSlash(rel)
+}
+
+func (m *manifest) addFile(rf receivedFile) {
+	m.entries = append(m.entries, manifestEntry{
+		Path:      m.relPath(rf.path),
+		Type:      "file",
+		Size:      rf.size,
+		Mode:      fmt.Sprintf("%#o", rf.mode&os.ModePerm),
+		Mtime:     unixTime(rf.mtime),
+		Checksums: rf.sums,
+	})
+}
+
+func (m *manifest) addDir(path string, mode os.FileMode, mtime time.Time) {
+	m.entries = append(m.entries, manifestEntry{
+		Path:  m.relPath(path),
+		Type:  "dir",
+		Mode:  fmt.Sprintf("%#o", mode&os.ModePerm),
+		Mtime: unixTime(mtime),
+	})
+}
+
+// Write the manifest at the root of the directory user uploaded, replacing it atomically.
+// It gets the same mode and owner as the files user uploads.
+func (m *manifest) write(config scpConfig, user string) error {
+	format := config.Manifest
+	sort.Slice(m.entries, func(i, j int) bool { return m.entries[i].Path < m.entries[j].Path })
+
+	filename := filepath.Join(m.root, "MANIFEST."+format)
+	f, err := createTempFile(filename)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	err = f.Chmod(config.uploadFileMode(user, 0644))
+	if err == nil {
+		err = config.chownUpload(f.Name())
+	}
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case manifestSHA256:
+		err = m.writeSHA256(f)
+	case manifestJSON:
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(m.entries)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = commitUpload(f, filename, overwriteReplace, slog.Default())
+	if err == nil {
+		slog.Info("Wrote manifest", "path", filename, "entries", len(m.entries))
+	}
+	return err
+}
+
+func (m *manifest) writeSHA256(w io.Writer) error {
+	for _, entry := range m.entries {
+		if entry.Type != "file" {
+			continue
+		}
+		_, err := fmt.Fprintf(w, "%s  %s\n", entry.Checksums["sha256"], entry.Path)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
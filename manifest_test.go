@@ -0,0 +1,46 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestManifestWrite(t *testing.T) {
+	root := t.TempDir()
+	m := &manifest{root: root}
+	m.addFile(receivedFile{path: filepath.Join(root, "sub", "b"), size: 6, mode: 0644, sums: map[string]string{"sha256": "bb"}})
+	m.addDir(filepath.Join(root, "sub"), 0755, time.Time{})
+	m.addFile(receivedFile{path: filepath.Join(root, "a"), size: 6, mode: 0600, sums: map[string]string{"sha256": "aa"}})
+
+	tests := []struct {
+		user     string
+		expected os.FileMode
+	}{
+		{"scpuser", 0640},
+		{"forced", 0600},
+	}
+	for _, test := range tests {
+		config := scpConfig{Manifest: manifestSHA256, umask: 027, userFileModes: map[string]os.FileMode{"forced": 0600}}
+		err := m.write(config, test.user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		filename := filepath.Join(root, "MANIFEST.sha256")
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "aa  a\nbb  sub/b\n" {
+			t.Errorf("Unexpected manifest %q", data)
+		}
+		fi, err := os.Stat(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode() != test.expected {
+			t.Errorf("%s: expected mode %v, got %v", test.user, test.expected, fi.Mode())
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	activeConnections = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "simplescp_active_connections",
+		Help: "Number of SSH connections currently open.",
+	})
+	activeSessions = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "simplescp_active_sessions",
+		Help: "Number of commands (scp or otherwise) currently running.",
+	})
+	authAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "simplescp_auth_attempts_total",
+		Help: "Authentication attempts, by method and result.",
+	}, []string{"method", "result"})
+	channelBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "simplescp_bytes_total",
+		Help: "Bytes going through session channels, by direction (in or out).",
+	}, []string{"direction"})
+	filesTransferred = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "simplescp_files_transferred_total",
+		Help: "Files handled, by direction (upload or download) and result.",
+	}, []string{"direction", "result"})
+	transferDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "simplescp_transfer_duration_seconds",
+		Help:    "Time taken to transfer a file, by direction (upload or download).",
+		Buckets: prometheus.ExponentialBuckets(0.01, 4, 10),
+	}, []string{"direction"})
+	protocolErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "simplescp_protocol_errors_total",
+		Help: "Errors while talking scp with clients, by type.",
+	}, []string{"type"})
+)
+
+// Types of protocol errors we keep track of
+const (
+	errMalformedMessage   = "malformed_message"
+	errUnexpectedEnd      = "unexpected_end_dir"
+	errClientReported     = "client_reported"
+	errAmbiguousTarget    = "ambiguous_target"
+	errUnsupportedCommand = "unsupported_command"
+	errBadCommand         = "bad_command"
+)
+
+// Record the outcome of a file transfer in the audit log and our metrics, and run any hooks for it
+func (config scpConfig) recordTransfer(conn *connState, direction string, path string, size int64, start time.Time, sums map[string]string, err error) {
+	config.audit.logTransfer(conn, direction, path, size, start, sums, err)
+
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	filesTransferred.WithLabelValues(direction, result).Inc()
+	if err != nil {
+		return
+	}
+	transferDuration.WithLabelValues(direction).Observe(time.Since(start).Seconds())
+
+	event := newHookEvent(eventPostDownload, conn)
+	if direction == "upload" {
+		event.Event = eventPostUpload
+	}
+	event.Path = path
+	event.Size = size
+	event.Checksums = sums
+	config.fireHook(conn, event)
+}
+
+// Channel that keeps count of the bytes read from and written to it
+type countingChannel struct {
+	ssh.Channel
+}
+
+func (c countingChannel) Read(data []byte) (int, error) {
+	n, err := c.Channel.Read(data)
+	channelBytes.WithLabelValues("in").Add(float64(n))
+	return n, err
+}
+
+func (c countingChannel) Write(data []byte) (int, error) {
+	n, err := c.Channel.Write(data)
+	channelBytes.WithLabelValues("out").Add(float64(n))
+	return n, err
+}
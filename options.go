@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/flynn/go-shlex"
+	"golang.org/x/crypto/ssh"
+)
+
+type scpOptions struct {
+	To           bool
+	From         bool
+	TargetIsDir  bool
+	Recursive    bool
+	PreserveMode bool
+	fileNames    []string
+}
+
+// Payload of an "exec" request
+type execRequest struct {
+	Command string
+}
+
+// Split the command of an exec request into its arguments
+func parseCommand(payload []byte) ([]string, error) {
+	var req execRequest
+	err := ssh.Unmarshal(payload, &req)
+	if err != nil {
+		return nil, errors.New("malformed exec request")
+	}
+	args, err := shlex.Split(req.Command)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, errors.New("empty command")
+	}
+	return args, nil
+}
+
+// Parse the arguments scp was called with (minus "scp" itself). Flags can be combined ("-pr") and
+// come before any file names, same as with scp's getopt.
+//
+// UNDOCUMENTED scp OPTIONS:
+//
+//	-t: "TO", our server will be receiving files
+//	-f: "FROM", our server will be sending files
+//	-d: Target is expected to be a directory
+//
+// DOCUMENTED scp OPTIONS:
+//
+//	-r: Recursively copy entire directories (follows symlinks)
+//	-p: Preserve modification mtime, atime and mode of files
+//	-v, -q: Verbose and quiet mode, these are more of a local client thing
+//	-T: Don't check file names sent by the server, again only for the client
+func parseSCPOptions(args []string) (scpOptions, error) {
+	opts := scpOptions{fileNames: make([]string, 0)}
+
+	i := 0
+	for ; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			i++
+			break
+		}
+		// "-" on its own is a file name
+		if len(arg) < 2 || arg[0] != '-' {
+			break
+		}
+		for _, flag := range arg[1:] {
+			switch flag {
+			case 't':
+				opts.To = true
+			case 'f':
+				opts.From = true
+			case 'd':
+				opts.TargetIsDir = true
+			case 'r':
+				opts.Recursive = true
+			case 'p':
+				opts.PreserveMode = true
+			case 'v', 'q', 'T':
+			default:
+				return opts, fmt.Errorf("unknown option -%c", flag)
+			}
+		}
+	}
+	opts.fileNames = append(opts.fileNames, args[i:]...)
+	for _, name := range opts.fileNames {
+		// Nothing can be called that, and the rest of the code can count on names having at least a character
+		if len(name) == 0 {
+			return opts, errors.New("empty file name")
+		}
+	}
+
+	if opts.To == opts.From {
+		return opts, errors.New("exactly one of -t and -f is required")
+	}
+	if opts.From && len(opts.fileNames) == 0 {
+		return opts, errors.New("no files to send")
+	}
+	return opts, nil
+}
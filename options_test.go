@@ -0,0 +1,62 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestParseSCPOptions(t *testing.T) {
+	tests := []struct {
+		args []string
+		opts scpOptions
+		err  bool
+	}{
+		{args: []string{"-t", "dir"}, opts: scpOptions{To: true, fileNames: []string{"dir"}}},
+		{args: []string{"-prdt", "--", "dir"}, opts: scpOptions{To: true, TargetIsDir: true, Recursive: true, PreserveMode: true, fileNames: []string{"dir"}}},
+		{args: []string{"-v", "-q", "-T", "-f", "a", "b"}, opts: scpOptions{From: true, fileNames: []string{"a", "b"}}},
+		{args: []string{"-f", "--", "-r", "--"}, opts: scpOptions{From: true, fileNames: []string{"-r", "--"}}},
+		{args: []string{"-t", "-"}, opts: scpOptions{To: true, fileNames: []string{"-"}}},
+		// Flags stop at the first file name
+		{args: []string{"-f", "a", "-r"}, opts: scpOptions{From: true, fileNames: []string{"a", "-r"}}},
+		{args: []string{"-t", "-x", "dir"}, err: true},
+		{args: []string{"-r", "dir"}, err: true},
+		{args: []string{"-tf", "dir"}, err: true},
+		{args: []string{"-f"}, err: true},
+		{args: []string{"-t", ""}, err: true},
+		{args: []string{"-f", "a", ""}, err: true},
+		{args: []string{}, err: true},
+	}
+
+	for _, test := range tests {
+		opts, err := parseSCPOptions(test.args)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %+v", test.args, opts)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", test.args, err)
+			continue
+		}
+		if !reflect.DeepEqual(opts, test.opts) {
+			t.Errorf("%q: expected %+v, got %+v", test.args, test.opts, opts)
+		}
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	args, err := parseCommand(ssh.Marshal(execRequest{`scp -t 'a b'`}))
+	if err != nil || !reflect.DeepEqual(args, []string{"scp", "-t", "a b"}) {
+		t.Errorf("got %q, %v", args, err)
+	}
+
+	for _, payload := range [][]byte{nil, {0, 0}, ssh.Marshal(execRequest{""}), ssh.Marshal(execRequest{"  "})} {
+		_, err := parseCommand(payload)
+		if err == nil {
+			t.Errorf("%q: expected an error", payload)
+		}
+	}
+}
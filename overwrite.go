@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/FranGM/simplescp/scp"
+)
+
+// What to do when an upload targets a file that already exists
+type overwritePolicy string
+
+const (
+	overwriteReplace overwritePolicy = "overwrite" // Replace the existing file (default)
+	overwriteRefuse  overwritePolicy = "refuse"    // Report an error to the client and skip the file
+	overwriteRename  overwritePolicy = "rename"    // Store the upload as "file (1).txt", "file (2).txt"...
+	overwriteVersion overwritePolicy = "version"   // Keep the existing file renamed with its modification time
+)
+
+// Layout used for the timestamp of versioned files
+const versionTimeFormat = "20060102T150405.000000000"
+
+func parseOverwritePolicy(policy string) (overwritePolicy, error) {
+	switch p := overwritePolicy(strings.ToLower(policy)); p {
+	case "":
+		return overwriteReplace, nil
+	case overwriteReplace, overwriteRefuse, overwriteRename, overwriteVersion:
+		return p, nil
+	}
+	return "", fmt.Errorf("Unknown overwrite policy %q", policy)
+}
+
+// Make sure all configured overwrite policies are valid
+func (c *scpConfig) initOverwritePolicies() error {
+	if _, err := parseOverwritePolicy(c.OverwritePolicy); err != nil {
+		return err
+	}
+	for user, policy := range c.UserOverwritePolicies {
+		if _, err := parseOverwritePolicy(policy); err != nil {
+			return fmt.Errorf("%v for user %q", err, user)
+		}
+	}
+	return nil
+}
+
+// Policy that applies to uploads from user, falling back to the server wide one
+func (config scpConfig) overwritePolicyFor(user string) overwritePolicy {
+	policy, ok := config.UserOverwritePolicies[user]
+	if !ok {
+		policy = config.OverwritePolicy
+	}
+	// Policies are validated on startup, so this can't fail
+	p, _ := parseOverwritePolicy(policy)
+	return p
+}
+
+func fileExists(filename string) bool {
+	_, err := os.Lstat(filename)
+	return err == nil
+}
+
+// Upload refused because of overwriteRefuse
+var errFileExists = errors.New("File exists")
+
+// Check before receiving anything if policy allows us to write to filename.
+// If not, the returned *scp.PolicyError says why.
+func checkOverwrite(filename string, name string, policy overwritePolicy, log *slog.Logger) error {
+	if policy == overwriteRefuse && fileExists(filename) {
+		log.Warn("Refusing to overwrite existing file", "path", filename)
+		return &scp.PolicyError{Name: name, Err: errFileExists}
+	}
+	return nil
+}
+
+// Get filename ready to be replaced by an upload and return the path the upload should be stored as
+func prepareOverwrite(filename string, policy overwritePolicy, log *slog.Logger) (string, error) {
+	fi, err := os.Lstat(filename)
+	if err != nil {
+		// Nothing to overwrite
+		return filename, nil
+	}
+
+	switch policy {
+	case overwriteRefuse:
+		return "", &os.PathError{Op: "rename", Path: filename, Err: os.ErrExist}
+	case overwriteRename:
+		newName := freeNumberedName(filename)
+		log.Info("File already exists, storing upload under a new name", "path", filename, "new_path", newName)
+		return newName, nil
+	case overwriteVersion:
+		versionName := addFilenameSuffix(filename, "."+fi.ModTime().Format(versionTimeFormat))
+		if fileExists(versionName) {
+			// Uploads with -p can bring the same time back, and that version has to be kept too
+			versionName = freeNumberedName(versionName)
+		}
+		log.Info("Keeping previous version of file", "path", filename, "version_path", versionName)
+		err := os.Rename(filename, versionName)
+		if err != nil {
+			return "", err
+		}
+	}
+	return filename, nil
+}
+
+// Insert suffix right before filename's extension
+func addFilenameSuffix(filename string, suffix string) string {
+	ext := filepath.Ext(filename)
+	if ext == filepath.Base(filename) {
+		// Hidden files like ".profile" have no extension
+		ext = ""
+	}
+	return strings.TrimSuffix(filename, ext) + suffix + ext
+}
+
+// Find the first "name (N).ext" that doesn't exist yet
+func freeNumberedName(filename string) string {
+	for i := 1; ; i++ {
+		candidate := addFilenameSuffix(filename, fmt.Sprintf(" (%d)", i))
+		if !fileExists(candidate) {
+			return candidate
+		}
+	}
+}
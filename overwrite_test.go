@@ -0,0 +1,94 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAddFilenameSuffix(t *testing.T) {
+	tests := []struct {
+		filename string
+		expected string
+	}{
+		{"file.txt", "file (1).txt"},
+		{"dir/file.tar.gz", "dir/file.tar (1).gz"},
+		{"file", "file (1)"},
+		{".profile", ".profile (1)"},
+		{"dir.d/file", "dir.d/file (1)"},
+	}
+	for _, test := range tests {
+		got := addFilenameSuffix(filepath.FromSlash(test.filename), " (1)")
+		if got != filepath.FromSlash(test.expected) {
+			t.Errorf("%q: expected %q, got %q", test.filename, test.expected, got)
+		}
+	}
+}
+
+func TestFreeNumberedName(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]int{"file.txt": 1, "file (1).txt": 1, "file (2).txt": 1})
+	got := freeNumberedName(filepath.Join(dir, "file.txt"))
+	if got != filepath.Join(dir, "file (3).txt") {
+		t.Errorf("Expected file (3).txt, got %q", got)
+	}
+}
+
+func TestPrepareOverwrite(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "file.txt")
+	missing := filepath.Join(dir, "missing.txt")
+	writeFiles(t, dir, map[string]int{"file.txt": 1})
+
+	for _, policy := range []overwritePolicy{overwriteReplace, overwriteRefuse, overwriteRename, overwriteVersion} {
+		got, err := prepareOverwrite(missing, policy, slog.Default())
+		if err != nil || got != missing {
+			t.Errorf("%s: nothing to overwrite, expected %q, got %q, %v", policy, missing, got, err)
+		}
+	}
+
+	got, err := prepareOverwrite(filename, overwriteReplace, slog.Default())
+	if err != nil || got != filename {
+		t.Errorf("overwrite: expected %q, got %q, %v", filename, got, err)
+	}
+	_, err = prepareOverwrite(filename, overwriteRefuse, slog.Default())
+	if err == nil {
+		t.Errorf("refuse: expected an error")
+	}
+	got, err = prepareOverwrite(filename, overwriteRename, slog.Default())
+	if err != nil || got != filepath.Join(dir, "file (1).txt") {
+		t.Errorf("rename: expected file (1).txt, got %q, %v", got, err)
+	}
+}
+
+func TestVersionedNames(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "file.txt")
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 600, time.Local)
+	versionName := filepath.Join(dir, "file.20200102T030405.000000600.txt")
+
+	// Uploading the same file with -p twice leaves two versions with the same time
+	for i, expected := range []string{versionName, filepath.Join(dir, "file.20200102T030405.000000600 (1).txt")} {
+		err := os.WriteFile(filename, []byte{byte(i)}, 0644)
+		if err == nil {
+			err = os.Chtimes(filename, mtime, mtime)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := prepareOverwrite(filename, overwriteVersion, slog.Default())
+		if err != nil || got != filename {
+			t.Fatalf("Expected %q, got %q, %v", filename, got, err)
+		}
+		if fileExists(filename) {
+			t.Errorf("%q should have been moved out of the way", filename)
+		}
+		data, err := os.ReadFile(expected)
+		if err != nil || len(data) != 1 || data[0] != byte(i) {
+			t.Errorf("Expected version %d to be kept as %q, got %v, %v", i, expected, data, err)
+		}
+	}
+}
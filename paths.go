@@ -0,0 +1,17 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// Whether path is dir itself or something inside it. This is what keeps clients inside the shared directory,
+// so it goes by path components rather than a string prefix (/srv/share isn't inside /srv/sh), and leaves
+// comparing volume names and their case to filepath.
+func insideDir(dir string, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestInsideDir(t *testing.T) {
+	dir := filepath.FromSlash("/srv/share")
+	tests := []struct {
+		path   string
+		inside bool
+	}{
+		{"/srv/share", true},
+		{"/srv/share/a/b", true},
+		{"/srv/share/..a", true},
+		{"/srv/sharedir", false},
+		{"/srv/sh", false},
+		{"/srv", false},
+		{"/etc/passwd", false},
+	}
+	for _, test := range tests {
+		path := filepath.FromSlash(test.path)
+		if runtime.GOOS == "windows" {
+			dir, path = `C:`+dir, `C:`+path
+		}
+		if insideDir(dir, path) != test.inside {
+			t.Errorf("insideDir(%q, %q) should be %v", dir, path, test.inside)
+		}
+	}
+}
+
+func TestGeneratePath(t *testing.T) {
+	config := scpConfig{Dir: filepath.FromSlash("/srv/share")}
+	path := config.generatePath([]string{"a"}, "b")
+	if path != filepath.FromSlash("/srv/share/a/b") {
+		t.Errorf("got %q", path)
+	}
+	if insideDir(config.Dir, config.generatePath(nil, "../../etc")) {
+		t.Errorf("%q shouldn't be inside %q", "../../etc", config.Dir)
+	}
+	if runtime.GOOS == "windows" {
+		// Volume names don't take the path anywhere else
+		path := config.generatePath([]string{`D:\a`}, `C:b`)
+		if path != `\srv\share\a\b` {
+			t.Errorf("got %q", path)
+		}
+	}
+}
+
+func TestJailedPath(t *testing.T) {
+	config := scpConfig{Dir: filepath.FromSlash("/srv/share")}
+	path, err := config.jailedPath("a/b")
+	if err != nil || path != filepath.FromSlash("/srv/share/a/b") {
+		t.Errorf("Got %q, %v", path, err)
+	}
+	// Whatever is outside isn't there as far as clients know
+	_, err = config.jailedPath("../../etc/passwd")
+	var pathErr *os.PathError
+	if !errors.As(err, &pathErr) || !os.IsNotExist(err) || pathErr.Path != "../../etc/passwd" {
+		t.Errorf("Expected a not found error for the path as given, got %v", err)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/user"
+	"strconv"
+)
+
+// Parse a permission mode written in octal, like "0640"
+func parseMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("Invalid mode %q", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+func parseUserModes(modes map[string]string) (map[string]os.FileMode, error) {
+	parsed := make(map[string]os.FileMode)
+	for user, s := range modes {
+		mode, err := parseMode(s)
+		if err != nil {
+			return nil, fmt.Errorf("%v for user %q", err, user)
+		}
+		parsed[user] = mode
+	}
+	return parsed, nil
+}
+
+// Resolve who uploads should belong to. Users and groups can be given by name or numeric id.
+func lookupOwner(owner string, group string) (uid int, gid int, err error) {
+	uid, gid = -1, -1
+	if len(owner) > 0 {
+		uid, err = strconv.Atoi(owner)
+		if err != nil {
+			u, lerr := user.Lookup(owner)
+			if lerr != nil {
+				return -1, -1, lerr
+			}
+			uid, err = strconv.Atoi(u.Uid)
+			if err != nil {
+				return -1, -1, fmt.Errorf("User %q has a non numeric uid %q", owner, u.Uid)
+			}
+		}
+	}
+	if len(group) > 0 {
+		gid, err = strconv.Atoi(group)
+		if err != nil {
+			g, lerr := user.LookupGroup(group)
+			if lerr != nil {
+				return -1, -1, lerr
+			}
+			gid, err = strconv.Atoi(g.Gid)
+			if err != nil {
+				return -1, -1, fmt.Errorf("Group %q has a non numeric gid %q", group, g.Gid)
+			}
+		}
+	}
+	return uid, gid, nil
+}
+
+func (c *scpConfig) initUploadPermissions() error {
+	var err error
+	c.umask, err = parseMode(c.Umask)
+	if err != nil {
+		return fmt.Errorf("%v for umask", err)
+	}
+	c.userFileModes, err = parseUserModes(c.UserFileModes)
+	if err != nil {
+		return err
+	}
+	c.userDirModes, err = parseUserModes(c.UserDirModes)
+	if err != nil {
+		return err
+	}
+	c.uploadUID, c.uploadGID, err = lookupOwner(c.UploadOwner, c.UploadGroup)
+	if err != nil {
+		return err
+	}
+	if len(c.UploadOwner) > 0 || len(c.UploadGroup) > 0 {
+		slog.Info("Changing ownership of uploads", "uid", c.uploadUID, "gid", c.uploadGID)
+	}
+	return nil
+}
+
+// Mode an uploaded file gets: the one forced for user if there's one, otherwise whatever the client
+// asked for minus the umask. Setuid, setgid and sticky bits are never kept.
+func (config scpConfig) uploadFileMode(user string, mode os.FileMode) os.FileMode {
+	if forced, ok := config.userFileModes[user]; ok {
+		return forced
+	}
+	return mode & os.ModePerm &^ config.umask
+}
+
+// Same as uploadFileMode, for directories
+func (config scpConfig) uploadDirMode(user string, mode os.FileMode) os.FileMode {
+	if forced, ok := config.userDirModes[user]; ok {
+		return forced
+	}
+	return mode & os.ModePerm &^ config.umask
+}
+
+// Hand an upload over to the configured owner and group, if any
+func (config scpConfig) chownUpload(path string) error {
+	if len(config.UploadOwner) == 0 && len(config.UploadGroup) == 0 {
+		return nil
+	}
+	return os.Lchown(path, config.uploadUID, config.uploadGID)
+}
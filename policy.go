@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"path/filepath"
+	"strings"
+
+	"github.com/FranGM/simplescp/scp"
+)
+
+// Check if name matches a filename pattern. Patterns are globs (like "*.csv")
+// or plain extensions (like ".exe"), and are matched case insensitively against the base name.
+func matchesFilePattern(pattern string, name string) bool {
+	pattern = strings.ToLower(pattern)
+	name = strings.ToLower(filepath.Base(name))
+	if strings.HasPrefix(pattern, ".") && !strings.ContainsAny(pattern, "*?[") {
+		return strings.HasSuffix(name, pattern)
+	}
+	matched, err := filepath.Match(pattern, name)
+	if err != nil {
+		slog.Warn("Ignoring malformed file pattern", "pattern", pattern, "err", err)
+		return false
+	}
+	return matched
+}
+
+func matchesAnyFilePattern(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matchesFilePattern(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reasons checkUploadPolicy rejects uploads for
+var (
+	errFileTooLarge       = errors.New("File too large")
+	errFileTypeNotAllowed = errors.New("File type not allowed")
+	errReservedName       = errors.New("File name reserved for uploads in progress")
+)
+
+// Check that an upload announced by a "C" message is allowed by the configured size limit and file types.
+// If not, the returned *scp.PolicyError says why.
+func (config scpConfig) checkUploadPolicy(name string, size uint64, log *slog.Logger) error {
+	// We'd take it for one of our own temporary or partial files, hide it and eventually delete it
+	if isIncompleteUpload(name) {
+		log.Warn("Rejecting upload named like an upload in progress", "name", name)
+		return &scp.PolicyError{Name: name, Err: errReservedName}
+	}
+
+	if config.MaxFileSize > 0 && size > config.MaxFileSize {
+		log.Warn("Rejecting upload over the size limit", "name", name, "size", size, "limit", config.MaxFileSize)
+		return &scp.PolicyError{Name: name, Err: errFileTooLarge}
+	}
+
+	if matchesAnyFilePattern(config.DeniedFiles, name) {
+		log.Warn("Rejecting upload with a denied file type", "name", name)
+		return &scp.PolicyError{Name: name, Err: errFileTypeNotAllowed}
+	}
+
+	if len(config.AllowedFiles) > 0 && !matchesAnyFilePattern(config.AllowedFiles, name) {
+		log.Warn("Rejecting upload with a file type that isn't allowed", "name", name)
+		return &scp.PolicyError{Name: name, Err: errFileTypeNotAllowed}
+	}
+	return nil
+}
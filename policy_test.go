@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"testing"
+)
+
+func TestMatchesFilePattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		matches bool
+	}{
+		{"*.csv", "data.csv", true},
+		{"*.csv", "DATA.CSV", true},
+		{"*.csv", "dir/data.csv", true},
+		{"*.csv", "data.csv.exe", false},
+		{".exe", "setup.exe", true},
+		{".exe", "setup.EXE", true},
+		{".exe", "exe", false},
+		{".exe", "setup.exe.txt", false},
+		{"report-??.pdf", "report-01.pdf", true},
+		{"report-??.pdf", "report-001.pdf", false},
+		{"[", "[", false},
+	}
+
+	for _, test := range tests {
+		if matchesFilePattern(test.pattern, test.name) != test.matches {
+			t.Errorf("Matching %q against %q should be %v", test.name, test.pattern, test.matches)
+		}
+	}
+}
+
+func TestCheckUploadPolicy(t *testing.T) {
+	tests := []struct {
+		config   scpConfig
+		name     string
+		size     uint64
+		expected error
+	}{
+		{scpConfig{}, "anything.exe", 1 << 40, nil},
+		{scpConfig{}, ".a.123" + tempFileSuffix, 1, errReservedName},
+		{scpConfig{}, "dir/.a.abc" + partialFileSuffix, 1, errReservedName},
+		{scpConfig{MaxFileSize: 100}, "file", 100, nil},
+		{scpConfig{MaxFileSize: 100}, "file", 101, errFileTooLarge},
+		{scpConfig{DeniedFiles: []string{".exe", "*.bat"}}, "setup.exe", 1, errFileTypeNotAllowed},
+		{scpConfig{DeniedFiles: []string{".exe", "*.bat"}}, "run.bat", 1, errFileTypeNotAllowed},
+		{scpConfig{DeniedFiles: []string{".exe", "*.bat"}}, "data.csv", 1, nil},
+		{scpConfig{AllowedFiles: []string{"*.csv", ".txt"}}, "data.csv", 1, nil},
+		{scpConfig{AllowedFiles: []string{"*.csv", ".txt"}}, "notes.txt", 1, nil},
+		{scpConfig{AllowedFiles: []string{"*.csv", ".txt"}}, "setup.exe", 1, errFileTypeNotAllowed},
+		// Being denied wins over being allowed
+		{scpConfig{AllowedFiles: []string{"*.csv"}, DeniedFiles: []string{"secret*"}}, "secret.csv", 1, errFileTypeNotAllowed},
+	}
+
+	for _, test := range tests {
+		err := test.config.checkUploadPolicy(test.name, test.size, slog.Default())
+		if !errors.Is(err, test.expected) {
+			t.Errorf("%q (%d bytes): expected %v, got %v", test.name, test.size, test.expected, err)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/FranGM/simplescp/scp"
+)
+
+// Space and number of files used under a directory tree
+type diskUsage struct {
+	bytes int64
+	files int64
+}
+
+// Walk dir adding up the size and number of all regular files under it.
+// Uploads still in progress don't count until they're in place.
+func getDiskUsage(dir string) (diskUsage, error) {
+	usage := diskUsage{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() && !isTempFile(path) && !isPartialFile(path) {
+			usage.bytes += info.Size()
+			usage.files++
+		}
+		return nil
+	})
+	return usage, err
+}
+
+// How long the usage of the shared directory is trusted for before walking it again.
+// Uploads keep it up to date in the meantime, so this only matters for changes made behind our back.
+const usageMaxAge = time.Minute
+
+// Usage of the shared directory, so it doesn't need to be walked for every upload.
+// A nil usageCache walks the directory every time.
+type usageCache struct {
+	mu      sync.Mutex
+	usage   diskUsage
+	updated time.Time
+}
+
+func (u *usageCache) get(dir string) (diskUsage, error) {
+	if u == nil {
+		return getDiskUsage(dir)
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.updated.IsZero() || time.Since(u.updated) > usageMaxAge {
+		usage, err := getDiskUsage(dir)
+		if err != nil {
+			return diskUsage{}, err
+		}
+		u.usage = usage
+		u.updated = time.Now()
+	}
+	return u.usage, nil
+}
+
+// Account for an upload that's just been stored
+func (u *usageCache) add(bytes int64, files int64) {
+	if u == nil {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.usage.bytes += bytes
+	u.usage.files += files
+}
+
+// Root directory that counts towards a user's quota. Every user shares the same directory for now,
+// so that's what their usage is measured over.
+func (config scpConfig) userRoot(user string) string {
+	return config.Dir
+}
+
+// Byte and file quotas of user, falling back to the ones for everybody. 0 means no limit
+func (config scpConfig) quotaFor(user string) (int64, int64) {
+	maxBytes, ok := config.UserQuotaBytes[user]
+	if !ok {
+		maxBytes = config.QuotaBytes
+	}
+	maxFiles, ok := config.UserQuotaFiles[user]
+	if !ok {
+		maxFiles = config.QuotaFiles
+	}
+	return maxBytes, maxFiles
+}
+
+// Bytes and files that storing size bytes at path adds to the shared directory.
+// When the upload replaces an existing file, only the difference counts.
+func uploadDelta(path string, size uint64, policy overwritePolicy) (int64, int64) {
+	if policy == overwriteReplace {
+		if fi, err := os.Lstat(path); err == nil && fi.Mode().IsRegular() {
+			return int64(size) - fi.Size(), 0
+		}
+	}
+	return int64(size), 1
+}
+
+// Reasons checkQuota rejects uploads for
+var (
+	errQuotaExceeded = errors.New("Disk quota exceeded")
+	errNoSpace       = errors.New("No space left on device")
+)
+
+// Check if a file of the given size can be stored at path (as allowed by policy) for user without going over
+// their quotas or under the free space threshold. If not, the returned *scp.PolicyError says why, using name
+// (the file as the client knows it).
+func (config scpConfig) checkQuota(user string, name string, path string, size uint64, policy overwritePolicy, log *slog.Logger) error {
+	maxBytes, maxFiles := config.quotaFor(user)
+	if maxBytes > 0 || maxFiles > 0 {
+		root := config.userRoot(user)
+		usage, err := config.usage.get(root)
+		if err != nil {
+			log.Error("Unable to compute disk usage", "user", user, "dir", root, "err", err)
+			return &scp.PolicyError{Name: name, Err: errQuotaExceeded}
+		}
+		log.Debug("Computed disk usage", "user", user, "bytes", usage.bytes, "files", usage.files)
+		bytes, files := uploadDelta(path, size, policy)
+		if maxBytes > 0 && usage.bytes+bytes > maxBytes {
+			log.Warn("Rejecting upload over the byte quota", "name", name, "user", user, "quota", maxBytes)
+			return &scp.PolicyError{Name: name, Err: errQuotaExceeded}
+		}
+		if maxFiles > 0 && usage.files+files > maxFiles {
+			log.Warn("Rejecting upload over the file quota", "name", name, "user", user, "quota", maxFiles)
+			return &scp.PolicyError{Name: name, Err: errQuotaExceeded}
+		}
+	}
+
+	if config.MinFreeSpace > 0 {
+		free, err := getFreeSpace(config.Dir)
+		if err != nil {
+			log.Error("Unable to get free space", "dir", config.Dir, "err", err)
+			return &scp.PolicyError{Name: name, Err: errNoSpace}
+		}
+		if free < size || free-size < config.MinFreeSpace {
+			log.Warn("Rejecting upload that would leave too little free space", "name", name, "free", free, "min_free", config.MinFreeSpace)
+			return &scp.PolicyError{Name: name, Err: errNoSpace}
+		}
+	}
+	return nil
+}
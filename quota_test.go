@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]int) {
+	for name, size := range files {
+		path := filepath.Join(dir, name)
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err == nil {
+			err = os.WriteFile(path, make([]byte, size), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDiskUsage(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]int{
+		"a":                          100,
+		"sub/b":                      50,
+		"sub/deeper/c":               25,
+		".d.123" + tempFileSuffix:    1000,
+		".e.abc" + partialFileSuffix: 1000,
+	})
+
+	usage, err := getDiskUsage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Uploads in progress don't count
+	if usage != (diskUsage{bytes: 175, files: 3}) {
+		t.Errorf("Expected 175 bytes in 3 files, got %+v", usage)
+	}
+}
+
+func TestUsageCache(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]int{"a": 100})
+
+	cache := &usageCache{}
+	usage, err := cache.get(dir)
+	if err != nil || usage != (diskUsage{bytes: 100, files: 1}) {
+		t.Fatalf("Expected 100 bytes in 1 file, got %+v, %v", usage, err)
+	}
+
+	// Until it's stale, the directory isn't walked again and uploads are added up instead
+	writeFiles(t, dir, map[string]int{"b": 1000})
+	cache.add(10, 1)
+	usage, _ = cache.get(dir)
+	if usage != (diskUsage{bytes: 110, files: 2}) {
+		t.Errorf("Expected the cached usage plus the upload, got %+v", usage)
+	}
+}
+
+func TestCheckQuota(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]int{"a": 100})
+	existing := filepath.Join(dir, "a")
+	missing := filepath.Join(dir, "b")
+
+	tests := []struct {
+		config   scpConfig
+		path     string
+		size     uint64
+		policy   overwritePolicy
+		expected error
+	}{
+		{scpConfig{QuotaBytes: 150}, missing, 50, overwriteReplace, nil},
+		{scpConfig{QuotaBytes: 150}, missing, 60, overwriteReplace, errQuotaExceeded},
+		// Replacing a file only takes up the difference...
+		{scpConfig{QuotaBytes: 150}, existing, 140, overwriteReplace, nil},
+		// ...unless the old one is kept around
+		{scpConfig{QuotaBytes: 150}, existing, 60, overwriteRename, errQuotaExceeded},
+		{scpConfig{QuotaBytes: 150}, existing, 60, overwriteVersion, errQuotaExceeded},
+		{scpConfig{QuotaFiles: 1}, missing, 1, overwriteReplace, errQuotaExceeded},
+		{scpConfig{QuotaFiles: 1}, existing, 1, overwriteReplace, nil},
+		{scpConfig{QuotaFiles: 2}, missing, 1, overwriteReplace, nil},
+		{scpConfig{MinFreeSpace: math.MaxUint64}, missing, 1, overwriteReplace, errNoSpace},
+		{scpConfig{MinFreeSpace: 1}, missing, 1, overwriteReplace, nil},
+		// Users can have quotas of their own, instead of the one for everybody
+		{scpConfig{UserQuotaBytes: map[string]int64{"scpuser": 150}}, missing, 60, overwriteReplace, errQuotaExceeded},
+		{scpConfig{UserQuotaBytes: map[string]int64{"other": 150}}, missing, 60, overwriteReplace, nil},
+		{scpConfig{QuotaBytes: 150, UserQuotaBytes: map[string]int64{"scpuser": 1000}}, missing, 60, overwriteReplace, nil},
+		{scpConfig{QuotaBytes: 1000, UserQuotaBytes: map[string]int64{"scpuser": 150}}, missing, 60, overwriteReplace, errQuotaExceeded},
+		{scpConfig{QuotaFiles: 5, UserQuotaFiles: map[string]int64{"scpuser": 1}}, missing, 1, overwriteReplace, errQuotaExceeded},
+		{scpConfig{QuotaFiles: 1, UserQuotaFiles: map[string]int64{"other": 5}}, missing, 1, overwriteReplace, errQuotaExceeded},
+	}
+
+	for i, test := range tests {
+		test.config.Dir = dir
+		err := test.config.checkQuota("scpuser", "name", test.path, test.size, test.policy, slog.Default())
+		if !errors.Is(err, test.expected) {
+			t.Errorf("%d: expected %v, got %v", i, test.expected, err)
+		}
+	}
+}
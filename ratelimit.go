@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/time/rate"
+)
+
+// Convert a limit expressed in Kbit/s (same unit as scp's -l) to a token bucket over bytes.
+// A limit of 0 means unlimited, in which case we return nil
+func newBandwidthLimiter(kbits int) *rate.Limiter {
+	if kbits <= 0 {
+		return nil
+	}
+	bytesPerSec := kbits * 1024 / 8
+	// Allow bursts of up to a second worth of data
+	return rate.NewLimiter(rate.Limit(bytesPerSec), bytesPerSec)
+}
+
+// Wait until all limiters have enough tokens for n bytes
+// Requests bigger than a limiter's burst size are split so WaitN never fails because of it
+func waitForBandwidth(limiters []*rate.Limiter, n int) error {
+	for _, l := range limiters {
+		remaining := n
+		for remaining > 0 {
+			chunk := remaining
+			if chunk > l.Burst() {
+				chunk = l.Burst()
+			}
+			err := l.WaitN(context.Background(), chunk)
+			if err != nil {
+				return err
+			}
+			remaining -= chunk
+		}
+	}
+	return nil
+}
+
+// Channel that throttles all data going through it, in both directions
+type throttledChannel struct {
+	ssh.Channel
+	limiters []*rate.Limiter
+}
+
+// Wrap channel so it honours all the given limiters (nil limiters are ignored)
+// If there's no limit to apply the channel is returned untouched
+func throttleChannel(channel ssh.Channel, limiters ...*rate.Limiter) ssh.Channel {
+	var active []*rate.Limiter
+	for _, l := range limiters {
+		if l != nil {
+			active = append(active, l)
+		}
+	}
+	if len(active) == 0 {
+		return channel
+	}
+	return &throttledChannel{Channel: channel, limiters: active}
+}
+
+func (t *throttledChannel) Read(data []byte) (int, error) {
+	n, err := t.Channel.Read(data)
+	if n > 0 {
+		if werr := waitForBandwidth(t.limiters, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+func (t *throttledChannel) Write(data []byte) (int, error) {
+	err := waitForBandwidth(t.limiters, len(data))
+	if err != nil {
+		return 0, err
+	}
+	return t.Channel.Write(data)
+}
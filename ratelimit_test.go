@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/time/rate"
+)
+
+func TestNewBandwidthLimiter(t *testing.T) {
+	if l := newBandwidthLimiter(0); l != nil {
+		t.Errorf("A limit of 0 should be unlimited, got %v", l.Limit())
+	}
+	// 800 Kbit/s are 102400 bytes per second, with bursts of a second worth of data
+	l := newBandwidthLimiter(800)
+	if l.Limit() != 102400 || l.Burst() != 102400 {
+		t.Errorf("Expected 102400 bytes/s with a burst of 102400, got %v and %v", l.Limit(), l.Burst())
+	}
+}
+
+func TestWaitForBandwidthChunking(t *testing.T) {
+	// WaitN fails straight away for anything over the burst size, so this only works if it's split up
+	l := rate.NewLimiter(10000, 1000)
+	start := time.Now()
+	err := waitForBandwidth([]*rate.Limiter{l}, 3000)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// The first 1000 bytes are there already, the other 2000 take 200ms to come in
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("3000 bytes at 10000 bytes/s should have been throttled, only took %v", elapsed)
+	}
+}
+
+// ssh.Channel that throws away everything written to it
+type discardChannel struct {
+	net.Conn
+}
+
+func (c discardChannel) Write(data []byte) (int, error) {
+	return len(data), nil
+}
+
+func (c discardChannel) CloseWrite() error {
+	return nil
+}
+
+func (c discardChannel) SendRequest(name string, wantReply bool, payload []byte) (bool, error) {
+	return true, nil
+}
+
+func (c discardChannel) Stderr() io.ReadWriter {
+	return nil
+}
+
+func TestUserRateLimits(t *testing.T) {
+	config := scpConfig{UserRateLimits: map[string]int{"alice": 80}}
+	config.initRateLimits()
+	if config.globalLimiter != nil || config.userLimiters["bob"] != nil {
+		t.Errorf("Only alice should have a limit")
+	}
+	alice := config.userLimiters["alice"]
+	if alice == nil || alice.Limit() != 10240 {
+		t.Fatalf("Expected alice to be limited to 10240 bytes/s, got %v", alice)
+	}
+
+	// Without limits channels are left alone
+	if _, ok := throttleChannel(discardChannel{}, config.globalLimiter, config.userLimiters["bob"]).(discardChannel); !ok {
+		t.Errorf("Channel without limits shouldn't be throttled")
+	}
+
+	// All of alice's channels share her limit: the burst goes to the first one, the second has to wait
+	first := throttleChannel(discardChannel{}, config.globalLimiter, alice)
+	second := throttleChannel(discardChannel{}, config.globalLimiter, alice)
+	start := time.Now()
+	for _, channel := range []ssh.Channel{first, second} {
+		_, err := channel.Write(make([]byte, 10240))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 800*time.Millisecond {
+		t.Errorf("Writing twice the per user limit should take about a second, took %v", elapsed)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/FranGM/simplescp/scp"
+	"golang.org/x/crypto/ssh"
+)
+
+// Exec command that clients can use to resume interrupted transfers:
+//
+//	simplescp-resume query <path> <size> <mtime>: Prints how many bytes of that upload we already have
+//	simplescp-resume put <path> <size> <mtime> <offset>: Receives the rest of an upload, starting at offset
+//	simplescp-resume get <path> <offset>: Sends the contents of path, starting at offset
+//
+// Uploads are identified by their path, size and mtime (0 if unknown), so changes to the file on
+// the client side don't end up mixed with what we had received before.
+// The command is only available with SIMPLESCP_RESUMABLEUPLOADS.
+const resumeCommand = "simplescp-resume"
+
+// Interrupted uploads are kept as ".<name>.<key>.simplescp-part" next to their final location
+const partialFileSuffix = ".simplescp-part"
+
+// Location of the partial file for an upload of size bytes and modification time mtime to filename
+func partialFilePath(filename string, size uint64, mtime int64) string {
+	key := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%d\x00%d", filename, size, mtime)))
+	dir, base := filepath.Split(filename)
+	return filepath.Join(dir, fmt.Sprintf(".%s.%x%s", base, key[:8], partialFileSuffix))
+}
+
+func isPartialFile(name string) bool {
+	base := filepath.Base(name)
+	return strings.HasPrefix(base, ".") && strings.HasSuffix(base, partialFileSuffix)
+}
+
+// Resolve a path given by the client, making sure it doesn't point outside of our shared directory
+func (config scpConfig) jailedPath(target string) (string, error) {
+	absTarget := config.generatePath(nil, target)
+	if !insideDir(config.Dir, absTarget) {
+		return "", &os.PathError{Op: "open", Path: target, Err: syscall.ENOENT}
+	}
+	return absTarget, nil
+}
+
+// Run a simplescp-resume command and return the exit status to report to the client
+func (config scpConfig) handleResume(channel ssh.Channel, args []string, conn *connState) uint8 {
+	var err error
+	switch {
+	case len(args) == 4 && args[0] == "query":
+		err = config.resumeQuery(channel, args[1], args[2], args[3], conn)
+	case len(args) == 5 && args[0] == "put":
+		err = config.resumePut(channel, args[1], args[2], args[3], args[4], conn)
+	case len(args) == 3 && args[0] == "get":
+		err = config.resumeGet(channel, args[1], args[2], conn)
+	default:
+		err = fmt.Errorf("usage: %s query <path> <size> <mtime> | put <path> <size> <mtime> <offset> | get <path> <offset>", resumeCommand)
+	}
+
+	if err != nil {
+		conn.log.Error("Resume command failed", "args", args, "err", err)
+		fmt.Fprintf(channel.Stderr(), "%s: %v\n", resumeCommand, err)
+		return 1
+	}
+	return 0
+}
+
+// Parse the size and mtime that identify an upload
+func parseUploadKey(size string, mtime string) (uint64, int64, error) {
+	s, err := strconv.ParseUint(size, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid size %q", size)
+	}
+	m, err := strconv.ParseInt(mtime, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid mtime %q", mtime)
+	}
+	return s, m, nil
+}
+
+// Print the number of bytes we already have for an upload
+func (config scpConfig) resumeQuery(channel ssh.Channel, target string, size string, mtime string, conn *connState) error {
+	filename, err := config.jailedPath(target)
+	if err != nil {
+		return err
+	}
+	s, m, err := parseUploadKey(size, mtime)
+	if err != nil {
+		return err
+	}
+
+	var offset int64
+	fi, err := os.Stat(partialFilePath(filename, s, m))
+	if err == nil && uint64(fi.Size()) <= s {
+		offset = fi.Size()
+	}
+	conn.log.Debug("Upload can be resumed", "path", filename, "offset", offset)
+	_, err = fmt.Fprintf(channel, "%d\n", offset)
+	return err
+}
+
+// Receive the remainder of an upload and move it into place once complete
+func (config scpConfig) resumePut(channel ssh.Channel, target string, size string, mtime string, offset string, conn *connState) error {
+	filename, err := config.jailedPath(target)
+	if err != nil {
+		return err
+	}
+	s, m, err := parseUploadKey(size, mtime)
+	if err != nil {
+		return err
+	}
+	off, err := strconv.ParseUint(offset, 10, 64)
+	if err != nil || off > s {
+		return fmt.Errorf("invalid offset %q", offset)
+	}
+
+	policy := config.overwritePolicyFor(conn.user)
+	err = config.checkUploadPolicy(target, s, conn.log)
+	if err == nil {
+		err = config.checkQuota(conn.user, target, filename, s, policy, conn.log)
+	}
+	if err == nil {
+		err = checkOverwrite(filename, target, policy, conn.log)
+	}
+	if err != nil {
+		config.recordTransfer(conn, "upload", filename, int64(s), time.Now(), nil, err)
+		return err
+	}
+
+	// What scp would announce for the file, minus the mode: clients have no way of sending it here
+	msg := scp.FileMessage(filepath.Base(filename), 0644, int64(s))
+	if m != 0 {
+		msg.Mtime = time.Unix(m, 0)
+		msg.Atime = msg.Mtime
+	}
+	u, err := config.startUpload(conn, filename, msg, true, int64(off))
+	if err != nil {
+		config.recordTransfer(conn, "upload", filename, int64(s), time.Now(), nil, err)
+		return err
+	}
+
+	conn.log.Info("Resuming upload", "path", filename, "offset", off)
+	nread, err := io.CopyN(u, channel, int64(s-off))
+	conn.log.Debug("Transferred file contents", "bytes", nread)
+	if err != nil {
+		// Whatever we got is kept so the upload can be resumed again
+		err = fmt.Errorf("transfer interrupted after %d bytes: %v", off+uint64(nread), err)
+		u.Abort(err)
+		return err
+	}
+	err = u.Commit()
+	if err != nil {
+		u.Abort(err)
+	}
+	return err
+}
+
+// Send the contents of a file starting at the given offset
+func (config scpConfig) resumeGet(channel ssh.Channel, target string, offset string, conn *connState) error {
+	filename, err := config.jailedPath(target)
+	if err != nil {
+		return err
+	}
+	off, err := strconv.ParseInt(offset, 10, 64)
+	if err != nil || off < 0 {
+		return fmt.Errorf("invalid offset %q", offset)
+	}
+
+	start := time.Now()
+	n, sums, err := config.sendFrom(channel, filename, target, off, conn)
+	config.recordTransfer(conn, "download", filename, n, start, sums, err)
+	return err
+}
+
+// Send filename, known to the client as target, from offset on. Checksums are still for the whole file.
+// Returns how many bytes were sent and their checksums
+func (config scpConfig) sendFrom(channel ssh.Channel, filename string, target string, off int64, conn *connState) (int64, map[string]string, error) {
+	if isIncompleteUpload(filename) {
+		return 0, nil, fmt.Errorf("%s: %v", target, syscall.ENOENT)
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%s: %v", target, errors.Unwrap(err))
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return 0, nil, fmt.Errorf("%s: not a regular file", target)
+	}
+	if off > fi.Size() {
+		return 0, nil, fmt.Errorf("offset %d is beyond the end of %s (%d bytes)", off, target, fi.Size())
+	}
+
+	// Hashing what the client already has leaves the file ready to send the rest
+	hashes := config.newTransferHashes()
+	_, err = io.CopyN(hashes.writer(), f, off)
+	if err != nil {
+		return 0, nil, err
+	}
+	conn.log.Info("Resuming download", "path", filename, "offset", off)
+	w, transfer := conn.startTransfer("download", filename, fi.Size()-off, channel)
+	defer conn.endTransfer(transfer)
+	n, err := io.Copy(io.MultiWriter(w, hashes.writer()), f)
+	conn.log.Debug("Sent file contents", "bytes", n)
+	if err != nil {
+		return n, nil, err
+	}
+	conn.log.Info("Sent file", "path", filename, "bytes", n, "checksums", hashes.sums())
+	return n, hashes.sums(), nil
+}
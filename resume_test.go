@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// Channel that reads what the client sends from in, and keeps everything written back
+type resumeChannel struct {
+	recordingChannel
+	in io.Reader
+}
+
+func (c *resumeChannel) Read(data []byte) (int, error) {
+	return c.in.Read(data)
+}
+
+func newResumeConfig(t *testing.T) scpConfig {
+	return scpConfig{Dir: t.TempDir(), ResumableUploads: true, spool: &eventSpool{path: t.TempDir()}}
+}
+
+func newResumeConn() *connState {
+	return &connState{user: "scpuser", remoteAddr: &net.TCPAddr{IP: net.IPv6loopback}, log: slog.Default()}
+}
+
+func TestResumeQuery(t *testing.T) {
+	config := newResumeConfig(t)
+	partial := partialFilePath(filepath.Join(config.Dir, "f"), 11, 100)
+	writeFiles(t, config.Dir, map[string]int{filepath.Base(partial): 5})
+
+	tests := []struct {
+		size     string
+		mtime    string
+		expected string
+	}{
+		{"11", "100", "5\n"},
+		// A different upload of the same file starts from scratch
+		{"11", "101", "0\n"},
+		{"12", "100", "0\n"},
+	}
+	for _, test := range tests {
+		channel := &resumeChannel{}
+		err := config.resumeQuery(channel, "f", test.size, test.mtime, newResumeConn())
+		if err != nil || channel.stdout.String() != test.expected {
+			t.Errorf("%s %s: expected %q, got %q, %v", test.size, test.mtime, test.expected, channel.stdout.String(), err)
+		}
+	}
+
+	if err := config.resumeQuery(&resumeChannel{}, "f", "eleven", "100", newResumeConn()); err == nil {
+		t.Errorf("Expected an error for an invalid size")
+	}
+}
+
+func TestResumePut(t *testing.T) {
+	config := newResumeConfig(t)
+	filename := filepath.Join(config.Dir, "f")
+	partial := partialFilePath(filename, 11, 100)
+	err := os.WriteFile(partial, []byte("hello wrong"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploads := filesTransferred.WithLabelValues("upload", "ok")
+	failures := filesTransferred.WithLabelValues("upload", "error")
+	before, failedBefore := testutil.ToFloat64(uploads), testutil.ToFloat64(failures)
+
+	// Can't resume past what we have, or past the end of the file
+	for _, offset := range []string{"12", "-1", "x"} {
+		err := config.resumePut(&resumeChannel{in: strings.NewReader("")}, "f", "11", "100", offset, newResumeConn())
+		if err == nil {
+			t.Errorf("Expected an error resuming at offset %s", offset)
+		}
+	}
+	err = os.WriteFile(partial, []byte("hello"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = config.resumePut(&resumeChannel{in: strings.NewReader("")}, "f", "11", "100", "6", newResumeConn())
+	if err == nil || !strings.Contains(err.Error(), "only 5 bytes") {
+		t.Errorf("Expected an error resuming past the partial file, got %v", err)
+	}
+
+	// An interrupted upload keeps what it got, privately
+	err = config.resumePut(&resumeChannel{in: strings.NewReader(" wo")}, "f", "11", "100", "5", newResumeConn())
+	if err == nil {
+		t.Errorf("Expected an error for an interrupted upload")
+	}
+	fi, err := os.Stat(partial)
+	if err != nil || fi.Size() != 8 || fi.Mode().Perm() != 0600 {
+		t.Errorf("Expected 8 bytes kept with mode 0600, got %v", fi)
+	}
+	if got := testutil.ToFloat64(failures); got != failedBefore+2 {
+		t.Errorf("Expected 2 failed uploads to be recorded, got %v", got-failedBefore)
+	}
+
+	// Anything after the offset is sent again
+	err = config.resumePut(&resumeChannel{in: strings.NewReader("world")}, "f", "11", "100", "6", newResumeConn())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil || string(data) != "hello world" {
+		t.Errorf("Expected %q, got %q, %v", "hello world", data, err)
+	}
+	if _, err := os.Stat(partial); !os.IsNotExist(err) {
+		t.Errorf("Expected the partial file to be gone, got %v", err)
+	}
+	if got := testutil.ToFloat64(uploads); got != before+1 {
+		t.Errorf("Expected the upload to be recorded, got %v", got-before)
+	}
+
+	// Same as any other upload, with checksums for the whole file
+	entries, err := os.ReadDir(config.spool.path)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("Expected one spooled event, got %v, %v", entries, err)
+	}
+	data, _ = os.ReadFile(filepath.Join(config.spool.path, entries[0].Name()))
+	var event hookEvent
+	json.Unmarshal(data, &event)
+	sum := sha256.Sum256([]byte("hello world"))
+	if event.Path != filename || event.Size != 11 || event.Checksums["sha256"] != hex.EncodeToString(sum[:]) {
+		t.Errorf("Unexpected event %s", data)
+	}
+}
+
+func TestResumePutReservedNames(t *testing.T) {
+	config := newResumeConfig(t)
+	for _, name := range []string{".a.123" + tempFileSuffix, filepath.Join("dir", ".b.abc"+partialFileSuffix)} {
+		err := config.resumePut(&resumeChannel{in: strings.NewReader("hello")}, name, "5", "100", "0", newResumeConn())
+		if !errors.Is(err, errReservedName) {
+			t.Errorf("%s: expected the name to be refused, got %v", name, err)
+		}
+	}
+	entries, err := os.ReadDir(config.Dir)
+	if err != nil || len(entries) > 0 {
+		t.Errorf("Expected nothing to be stored, got %v, %v", entries, err)
+	}
+}
+
+func TestResumeGet(t *testing.T) {
+	config := newResumeConfig(t)
+	err := os.WriteFile(filepath.Join(config.Dir, "f"), []byte("hello world"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, config.Dir, map[string]int{".g.abc" + partialFileSuffix: 10})
+	downloads := filesTransferred.WithLabelValues("download", "ok")
+	before := testutil.ToFloat64(downloads)
+
+	channel := &resumeChannel{}
+	err = config.resumeGet(channel, "f", "6", newResumeConn())
+	if err != nil || channel.stdout.String() != "world" {
+		t.Errorf("Expected %q, got %q, %v", "world", channel.stdout.String(), err)
+	}
+	if got := testutil.ToFloat64(downloads); got != before+1 {
+		t.Errorf("Expected the download to be recorded, got %v", got-before)
+	}
+
+	for _, test := range [][2]string{{"f", "12"}, {"f", "-1"}, {"missing", "0"}, {".g.abc" + partialFileSuffix, "0"}, {"../f", "0"}} {
+		channel := &resumeChannel{}
+		err := config.resumeGet(channel, test[0], test[1], newResumeConn())
+		if err == nil || channel.stdout.Len() > 0 {
+			t.Errorf("Expected an error getting %s from %s, got %v and %q", test[0], test[1], err, channel.stdout.String())
+		}
+	}
+}
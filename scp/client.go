@@ -0,0 +1,158 @@
+package scp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Options of a transfer, the same as those of the scp command
+type Options struct {
+	Recursive   bool // -r: Copy directories and everything in them
+	Preserve    bool // -p: Keep the modes and times of what's copied
+	TargetIsDir bool // -d: Target must be an existing directory
+}
+
+func (o Options) flags() string {
+	var flags string
+	if o.Recursive {
+		flags += " -r"
+	}
+	if o.Preserve {
+		flags += " -p"
+	}
+	if o.TargetIsDir {
+		flags += " -d"
+	}
+	return flags
+}
+
+// Quote s for a POSIX shell, which is what most scp servers run commands through
+func quote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// SinkCommand is the command that has an scp server receive files into target
+func SinkCommand(target string, opts Options) string {
+	return "scp" + opts.flags() + " -t -- " + quote(target)
+}
+
+// SourceCommand is the command that has an scp server send paths
+func SourceCommand(paths []string, opts Options) string {
+	cmd := "scp" + opts.flags() + " -f --"
+	for _, path := range paths {
+		cmd += " " + quote(path)
+	}
+	return cmd
+}
+
+type sessionStream struct {
+	io.Reader
+	io.Writer
+}
+
+// Run command on an scp server in a new session of client, and talk scp to it through transfer.
+// Returns the first error found by either side.
+func Run(client *ssh.Client, command string, transfer func(c *Conn) error) error {
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+
+	err = session.Start(command)
+	if err != nil {
+		return err
+	}
+
+	err = transfer(NewConn(sessionStream{stdout, stdin}))
+	// Let the server know we're done
+	stdin.Close()
+	werr := session.Wait()
+	if err != nil {
+		return err
+	}
+	if werr != nil && stderr.Len() > 0 {
+		return fmt.Errorf("%v: %s", werr, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return werr
+}
+
+// Upload sends local paths to target on the server client is connected to
+func Upload(client *ssh.Client, paths []string, target string, opts Options) error {
+	// Same as scp, several files can only go into a directory
+	if len(paths) > 1 {
+		opts.TargetIsDir = true
+	}
+	return Run(client, SinkCommand(target, opts), func(c *Conn) error {
+		return Send(c, paths, opts)
+	})
+}
+
+// Download receives paths from the server client is connected to into local target
+func Download(client *ssh.Client, paths []string, target string, opts Options) error {
+	// -d only makes sense for the end receiving files
+	local := opts
+	if len(paths) > 1 {
+		local.TargetIsDir = true
+	}
+	opts.TargetIsDir = false
+	return Run(client, SourceCommand(paths, opts), func(c *Conn) error {
+		// Only what was asked for, whatever the server sends
+		return ReceiveWith(c, target, local, ReceiveHooks{Expected: paths})
+	})
+}
+
+// RemotePath tells whether path refers to the server rather than the local machine. Like scp does,
+// remote paths are written as "host:path", although Copy only cares about the colon
+func RemotePath(path string) (host string, remote string, ok bool) {
+	i := strings.IndexByte(path, ':')
+	// Colons after a slash are part of a local path (like "./a:b")
+	if i < 0 || strings.ContainsRune(path[:i], '/') {
+		return "", path, false
+	}
+	// "host:" is the home directory, where scp servers start
+	remote = path[i+1:]
+	if len(remote) == 0 {
+		remote = "."
+	}
+	return path[:i], remote, true
+}
+
+// Copy copies srcs to dst through client, as "scp srcs dst" would. Either the sources or the target
+// have to be remote paths (see RemotePath), but not both
+func Copy(client *ssh.Client, srcs []string, dst string, opts Options) error {
+	if len(srcs) == 0 {
+		return errors.New("nothing to copy")
+	}
+
+	_, target, dstRemote := RemotePath(dst)
+	paths := make([]string, len(srcs))
+	for i, src := range srcs {
+		var srcRemote bool
+		_, paths[i], srcRemote = RemotePath(src)
+		if srcRemote == dstRemote {
+			return fmt.Errorf("%s and %s: exactly one side of a copy has to be remote", src, dst)
+		}
+	}
+
+	if dstRemote {
+		return Upload(client, paths, target, opts)
+	}
+	return Download(client, paths, target, opts)
+}
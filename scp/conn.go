@@ -0,0 +1,285 @@
+package scp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// Conn speaks the scp protocol over a stream, usually an ssh channel or session.
+// Reads are buffered, so once wrapped in a Conn the stream shouldn't be read from directly.
+type Conn struct {
+	r   *bufio.Reader
+	w   io.Writer
+	err error // First error reading from or writing to the stream
+}
+
+// NewConn starts talking scp over rw
+func NewConn(rw io.ReadWriter) *Conn {
+	c := &Conn{w: rw}
+	c.r = bufio.NewReader(errRecorder{rw, c})
+	return c
+}
+
+// Keeps track of read errors in c. Reaching the end of the stream isn't one
+type errRecorder struct {
+	r io.Reader
+	c *Conn
+}
+
+func (e errRecorder) Read(data []byte) (int, error) {
+	n, err := e.r.Read(data)
+	if err != nil && err != io.EOF && e.c.err == nil {
+		e.c.err = err
+	}
+	return n, err
+}
+
+// Err returns the first error reading from or writing to the stream. Once there's one,
+// there's no point in carrying on with the transfer
+func (c *Conn) Err() error {
+	return c.err
+}
+
+// Read raw data (like file contents) from the stream
+func (c *Conn) Read(data []byte) (int, error) {
+	return c.r.Read(data)
+}
+
+// Write raw data (like file contents) to the stream
+func (c *Conn) Write(data []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(data)
+	if err != nil {
+		c.err = err
+	}
+	return n, err
+}
+
+// Read a newline terminated line, without the newline.
+// Returns io.EOF only if the stream ended before anything could be read.
+func (c *Conn) readLine() (string, error) {
+	var line []byte
+	for {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			if err == io.EOF && len(line) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return string(line), err
+		}
+		if b == '\n' {
+			return string(line), nil
+		}
+		if len(line) >= MaxMessageLen {
+			return string(line), &ProtocolError{"control message too long"}
+		}
+		line = append(line, b)
+	}
+}
+
+// ReadMessage reads the next control message. Warnings and errors sent instead of a message
+// are returned as a *RemoteError
+func (c *Conn) ReadMessage() (Message, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return Message{}, err
+	}
+	return ParseMessage(line)
+}
+
+// ReceiveMessage reads the next C, D or E message. A T message coming before it is acknowledged,
+// and its times returned in the message that follows it.
+// Warnings from the other end are returned as a *RemoteError, and it's fine to keep reading after one.
+func (c *Conn) ReceiveMessage() (Message, error) {
+	var times *Message
+	for {
+		m, err := c.ReadMessage()
+		if err != nil {
+			if err == io.EOF && times != nil {
+				err = &ProtocolError{"expected C or D message after T"}
+			}
+			return m, err
+		}
+
+		switch m.Type {
+		case MsgTimes:
+			if times != nil {
+				return m, &ProtocolError{"expected C or D message after T"}
+			}
+			times = &m
+			err = c.SendOK()
+			if err != nil {
+				return m, err
+			}
+		case MsgEndDir:
+			if times != nil {
+				return m, &ProtocolError{"expected C or D message after T"}
+			}
+			return m, nil
+		default:
+			if times != nil {
+				m.Mtime = times.Mtime
+				m.Atime = times.Atime
+			}
+			return m, nil
+		}
+	}
+}
+
+// WriteMessage sends m without waiting for a reply
+func (c *Conn) WriteMessage(m Message) error {
+	_, err := io.WriteString(c, m.String()+"\n")
+	return err
+}
+
+// SendMessage sends m and waits for the other end to acknowledge it
+func (c *Conn) SendMessage(m Message) error {
+	err := c.WriteMessage(m)
+	if err != nil {
+		return err
+	}
+	return c.ReadStatus()
+}
+
+// ReadStatus reads the other end's reply to a message or to the contents of a file.
+// Returns nil if everything went fine, or a *RemoteError if it didn't
+func (c *Conn) ReadStatus() error {
+	status, err := c.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if status == StatusOK {
+		return nil
+	}
+
+	msg, err := c.readLine()
+	if err != nil {
+		return err
+	}
+	switch status {
+	case StatusWarning:
+		return &RemoteError{Msg: msg}
+	case StatusFatal:
+		return &RemoteError{Fatal: true, Msg: msg}
+	}
+	// Same as scp, anything else is taken as the start of a fatal error message
+	return &RemoteError{Fatal: true, Msg: string(status) + msg}
+}
+
+func (c *Conn) sendStatus(status byte, msg string) error {
+	_, err := c.Write([]byte(fmt.Sprintf("%c%s\n", status, msg)))
+	return err
+}
+
+// SendOK tells the other end everything is fine
+func (c *Conn) SendOK() error {
+	_, err := c.Write([]byte{StatusOK})
+	return err
+}
+
+// SendWarning tells the other end something failed, but the transfer can go on
+func (c *Conn) SendWarning(msg string) error {
+	return c.sendStatus(StatusWarning, msg)
+}
+
+// SendFatal tells the other end something failed and the transfer is over
+func (c *Conn) SendFatal(msg string) error {
+	return c.sendStatus(StatusFatal, msg)
+}
+
+// SendError tells the other end about err, which happened to the file it knows as name (see WireError)
+func (c *Conn) SendError(name string, err error) error {
+	return c.sendStatus(WireError(name, err))
+}
+
+// ReadFile copies the contents of the file announced by m, which must already have been acknowledged,
+// to w. It then reads the status the other end sends after them.
+// If writing to w fails, the rest of the file is still read so the transfer can go on, and the
+// write error is returned.
+func (c *Conn) ReadFile(m Message, w io.Writer) (int64, error) {
+	buf := make([]byte, 32*1024)
+	var written int64
+	var werr error
+	for remaining := m.Size; remaining > 0; {
+		chunk := buf
+		if int64(len(chunk)) > remaining {
+			chunk = chunk[:remaining]
+		}
+		n, err := c.r.Read(chunk)
+		if n > 0 && werr == nil {
+			var nw int
+			nw, werr = w.Write(chunk[:n])
+			written += int64(nw)
+			if werr == nil && nw < n {
+				werr = io.ErrShortWrite
+			}
+		}
+		remaining -= int64(n)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return written, err
+		}
+	}
+
+	err := c.ReadStatus()
+	if werr != nil {
+		return written, werr
+	}
+	return written, err
+}
+
+// WriteFile sends the contents of the file announced by m, which the other end must already have acknowledged,
+// reading them from r. It then waits for the other end to confirm it got them.
+// If reading from r fails, the rest of the file is padded with zeros so the transfer can go on, the other end is
+// told about it, and the read error is returned.
+func (c *Conn) WriteFile(m Message, r io.Reader) (int64, error) {
+	buf := make([]byte, 32*1024)
+	var read int64
+	var rerr error
+	for remaining := m.Size; remaining > 0; {
+		chunk := buf
+		if int64(len(chunk)) > remaining {
+			chunk = chunk[:remaining]
+		}
+		if rerr == nil {
+			n, err := io.ReadFull(r, chunk)
+			read += int64(n)
+			if err != nil {
+				rerr = err
+				if err == io.EOF || err == io.ErrUnexpectedEOF {
+					rerr = fmt.Errorf("file shrank while being sent")
+				}
+				clear(chunk[n:])
+			}
+		} else {
+			clear(chunk)
+		}
+		_, err := c.Write(chunk)
+		if err != nil {
+			return read, err
+		}
+		remaining -= int64(len(chunk))
+	}
+
+	if rerr != nil {
+		err := c.SendError(m.Name, rerr)
+		if err == nil {
+			err = c.ReadStatus()
+		}
+		if c.err != nil {
+			return read, c.err
+		}
+		return read, rerr
+	}
+
+	err := c.SendOK()
+	if err != nil {
+		return read, err
+	}
+	return read, c.ReadStatus()
+}
@@ -0,0 +1,75 @@
+package scp
+
+import (
+	"errors"
+	"os"
+)
+
+// ErrNotRegular is returned for anything that can't be copied as a file, like devices or sockets, or
+// directories without Recursive
+var ErrNotRegular = errors.New("not a regular file")
+
+// ProtocolError is a message that doesn't follow the scp protocol. A transfer can't go on after one
+type ProtocolError struct {
+	Msg string
+}
+
+func (e *ProtocolError) Error() string {
+	return "protocol error: " + e.Msg
+}
+
+// RemoteError is a warning or error reported by the other end of a transfer
+type RemoteError struct {
+	Fatal bool // The other end has given up on the transfer
+	Msg   string
+}
+
+func (e *RemoteError) Error() string {
+	return e.Msg
+}
+
+// PolicyError is a file the receiving end won't take because of its own rules (size limits,
+// quotas...) rather than because something failed. Err says which rule it broke
+type PolicyError struct {
+	Name string
+	Err  error
+}
+
+func (e *PolicyError) Error() string {
+	return e.Name + ": " + e.Err.Error()
+}
+
+func (e *PolicyError) Unwrap() error {
+	return e.Err
+}
+
+// WireError converts err to the status and message that tell the other end of a transfer about it.
+// name is the file err is about, as the other end knows it. Protocol errors are fatal and anything else
+// is a warning, so the transfer can carry on with the next file.
+func WireError(name string, err error) (byte, string) {
+	var perr *ProtocolError
+	if errors.As(err, &perr) {
+		return StatusFatal, "scp: " + perr.Error()
+	}
+	var polErr *PolicyError
+	if errors.As(err, &polErr) {
+		return StatusWarning, "scp: " + polErr.Error()
+	}
+
+	// The other end only needs to hear what went wrong, not which system call failed on what path
+	var pathErr *os.PathError
+	var linkErr *os.LinkError
+	var sysErr *os.SyscallError
+	switch {
+	case errors.As(err, &pathErr):
+		err = pathErr.Err
+	case errors.As(err, &linkErr):
+		err = linkErr.Err
+	case errors.As(err, &sysErr):
+		err = sysErr.Err
+	}
+	if len(name) == 0 {
+		return StatusWarning, "scp: " + err.Error()
+	}
+	return StatusWarning, "scp: " + name + ": " + err.Error()
+}
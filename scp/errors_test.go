@@ -0,0 +1,38 @@
+package scp
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestWireError(t *testing.T) {
+	errTooLarge := errors.New("File too large")
+	tests := []struct {
+		name   string
+		err    error
+		status byte
+		msg    string
+	}{
+		{"a", &os.PathError{Op: "open", Path: "/srv/a", Err: syscall.ENOENT}, StatusWarning, "scp: a: no such file or directory"},
+		{"a", fmt.Errorf("sending: %w", &os.LinkError{Op: "rename", Old: "x", New: "y", Err: syscall.EACCES}), StatusWarning, "scp: a: permission denied"},
+		{"a", &PolicyError{Name: "b", Err: errTooLarge}, StatusWarning, "scp: b: File too large"},
+		{"", &ProtocolError{"bad mode"}, StatusFatal, "scp: protocol error: bad mode"},
+		{"", errors.New("ambiguous target"), StatusWarning, "scp: ambiguous target"},
+	}
+
+	for _, test := range tests {
+		status, msg := WireError(test.name, test.err)
+		if status != test.status || msg != test.msg {
+			t.Errorf("%v: expected %d %q, got %d %q", test.err, test.status, test.msg, status, msg)
+		}
+	}
+
+	var perr *PolicyError
+	err := fmt.Errorf("upload: %w", &PolicyError{Name: "b", Err: errTooLarge})
+	if !errors.As(err, &perr) || !errors.Is(err, errTooLarge) {
+		t.Errorf("%v: not usable with errors.Is and errors.As", err)
+	}
+}
@@ -0,0 +1,14 @@
+package scp
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// LocalName tells whether name, as received in a C or D message, is a plain file name here and not just
+// for the other end. ValidName only rules out "/", while Windows also has "\", drive letters and
+// characters it won't have in file names.
+func LocalName(name string) bool {
+	return ValidName(name) && filepath.IsLocal(name) && filepath.Base(name) == name &&
+		!strings.ContainsAny(name, invalidNameChars)
+}
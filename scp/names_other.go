@@ -0,0 +1,6 @@
+// +build !windows
+
+package scp
+
+// Anything goes in file names, besides the separator
+const invalidNameChars = ""
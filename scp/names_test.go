@@ -0,0 +1,26 @@
+package scp
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestLocalName(t *testing.T) {
+	for _, name := range []string{"file", "file.txt", "..file", "a b"} {
+		if !LocalName(name) {
+			t.Errorf("%q should be valid", name)
+		}
+	}
+	for _, name := range []string{"", ".", "..", "a/b", "/a"} {
+		if LocalName(name) {
+			t.Errorf("%q shouldn't be valid", name)
+		}
+	}
+	if runtime.GOOS == "windows" {
+		for _, name := range []string{`a\b`, `..\..\x`, `C:a`, `a:stream`, "NUL", "a?"} {
+			if LocalName(name) {
+				t.Errorf("%q shouldn't be valid", name)
+			}
+		}
+	}
+}
@@ -0,0 +1,6 @@
+// +build windows
+
+package scp
+
+// Characters Windows doesn't allow in file names (":" would write to an alternate data stream instead)
+const invalidNameChars = `:*?"<>|`
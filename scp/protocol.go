@@ -0,0 +1,196 @@
+// Package scp implements the scp wire protocol, as spoken by "scp -t" (sink) and "scp -f" (source)
+// on the remote end of an ssh session. It can be used both to serve files to scp clients and to copy
+// files from or to any scp server.
+//
+// Every control message is a single line, acknowledged by the other end with a status code:
+//
+//	C<mode> <size> <name>: A file follows, of the given size
+//	D<mode> 0 <name>: Files that follow go in this directory, until the matching E
+//	E: End of the current directory
+//	T<mtime> <mtime usec> <atime> <atime usec>: Times of the C or D message that follows
+package scp
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Status codes sent in reply to messages and file contents. Warnings and fatal errors are
+// followed by a newline terminated message
+const (
+	StatusOK      byte = 0
+	StatusWarning byte = 1 // Something failed, but the transfer can go on
+	StatusFatal   byte = 2 // The transfer is over
+)
+
+// Types of control message
+const (
+	MsgFile   byte = 'C'
+	MsgDir    byte = 'D'
+	MsgEndDir byte = 'E'
+	MsgTimes  byte = 'T'
+)
+
+// Longest control message we accept, enough for any reasonable file name
+const MaxMessageLen = 8192
+
+// Message is an scp control message. Only the fields relevant to its type are set
+type Message struct {
+	Type  byte
+	Mode  os.FileMode // C and D
+	Size  int64       // C
+	Name  string      // C and D
+	Mtime time.Time   // T, or C and D if they came after a T
+	Atime time.Time   // T, or C and D if they came after a T
+}
+
+// FileMessage announces a file called name (no directories), with the given mode and size
+func FileMessage(name string, mode os.FileMode, size int64) Message {
+	return Message{Type: MsgFile, Name: name, Mode: mode, Size: size}
+}
+
+// DirMessage announces a directory called name (no parent directories), with the given mode
+func DirMessage(name string, mode os.FileMode) Message {
+	return Message{Type: MsgDir, Name: name, Mode: mode}
+}
+
+// EndDirMessage marks the end of the current directory
+func EndDirMessage() Message {
+	return Message{Type: MsgEndDir}
+}
+
+// TimesMessage sets the times of the file or directory announced next
+func TimesMessage(mtime time.Time, atime time.Time) Message {
+	return Message{Type: MsgTimes, Mtime: mtime, Atime: atime}
+}
+
+// HasTimes tells whether m came along with a T message
+func (m Message) HasTimes() bool {
+	return !m.Mtime.IsZero()
+}
+
+// String returns m as sent over the wire, minus the trailing newline
+func (m Message) String() string {
+	switch m.Type {
+	case MsgFile:
+		return fmt.Sprintf("C%04o %d %s", modeToWire(m.Mode), m.Size, m.Name)
+	case MsgDir:
+		return fmt.Sprintf("D%04o 0 %s", modeToWire(m.Mode), m.Name)
+	case MsgEndDir:
+		return "E"
+	case MsgTimes:
+		return fmt.Sprintf("T%d %d %d %d", m.Mtime.Unix(), m.Mtime.Nanosecond()/1000, m.Atime.Unix(), m.Atime.Nanosecond()/1000)
+	}
+	return fmt.Sprintf("unknown message type %q", m.Type)
+}
+
+// Permission bits as used by scp (like chmod) to an os.FileMode and back
+func modeFromWire(mode uint64) os.FileMode {
+	m := os.FileMode(mode) & os.ModePerm
+	if mode&04000 != 0 {
+		m |= os.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		m |= os.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
+
+func modeToWire(m os.FileMode) uint32 {
+	mode := uint32(m & os.ModePerm)
+	if m&os.ModeSetuid != 0 {
+		mode |= 04000
+	}
+	if m&os.ModeSetgid != 0 {
+		mode |= 02000
+	}
+	if m&os.ModeSticky != 0 {
+		mode |= 01000
+	}
+	return mode
+}
+
+// ValidName tells whether name can be sent in a C or D message: it has to name something
+// inside the current directory
+func ValidName(name string) bool {
+	return len(name) > 0 && name != "." && name != ".." && !strings.ContainsRune(name, '/')
+}
+
+// ParseMessage parses a control message, without its trailing newline.
+// Warnings and errors sent instead of a message are returned as a *RemoteError
+func ParseMessage(line string) (Message, error) {
+	if len(line) == 0 {
+		return Message{}, &ProtocolError{"empty control message"}
+	}
+
+	switch line[0] {
+	case StatusWarning, StatusFatal:
+		return Message{}, &RemoteError{Fatal: line[0] == StatusFatal, Msg: line[1:]}
+	case MsgEndDir:
+		if len(line) != 1 {
+			return Message{}, &ProtocolError{"malformed E message"}
+		}
+		return EndDirMessage(), nil
+	case MsgTimes:
+		return parseTimesMessage(line)
+	case MsgFile, MsgDir:
+		return parseFileMessage(line)
+	}
+	return Message{}, &ProtocolError{fmt.Sprintf("unknown control message type %q", line[0])}
+}
+
+// Parse a "C<mode> <size> <name>" or "D<mode> <size> <name>" message. Names can contain spaces
+func parseFileMessage(line string) (Message, error) {
+	m := Message{Type: line[0]}
+
+	fields := strings.SplitN(line[1:], " ", 3)
+	if len(fields) != 3 {
+		return m, &ProtocolError{fmt.Sprintf("malformed %c message", m.Type)}
+	}
+
+	if len(fields[0]) != 4 {
+		return m, &ProtocolError{"bad mode"}
+	}
+	mode, err := strconv.ParseUint(fields[0], 8, 32)
+	if err != nil {
+		return m, &ProtocolError{"bad mode"}
+	}
+	m.Mode = modeFromWire(mode)
+
+	m.Size, err = strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || m.Size < 0 {
+		return m, &ProtocolError{"bad size"}
+	}
+
+	if !ValidName(fields[2]) {
+		return m, &ProtocolError{"unexpected filename: " + fields[2]}
+	}
+	m.Name = fields[2]
+	return m, nil
+}
+
+// Parse a "T<mtime> <mtime usec> <atime> <atime usec>" message
+func parseTimesMessage(line string) (Message, error) {
+	fields := strings.Split(line[1:], " ")
+	if len(fields) != 4 {
+		return Message{}, &ProtocolError{"malformed T message"}
+	}
+	var values [4]int64
+	for i, field := range fields {
+		value, err := strconv.ParseInt(field, 10, 64)
+		if err != nil || value < 0 {
+			return Message{}, &ProtocolError{"malformed T message"}
+		}
+		values[i] = value
+	}
+	if values[1] > 999999 || values[3] > 999999 {
+		return Message{}, &ProtocolError{"bad usec in T message"}
+	}
+	return TimesMessage(time.Unix(values[0], values[1]*1000), time.Unix(values[2], values[3]*1000)), nil
+}
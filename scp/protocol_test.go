@@ -0,0 +1,332 @@
+package scp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseMessage(t *testing.T) {
+	tests := []struct {
+		line string
+		want string // Message as sent back over the wire, empty if it's invalid
+	}{
+		{"C0644 12 file.txt", "C0644 12 file.txt"},
+		{"C0644 12 name with spaces", "C0644 12 name with spaces"},
+		{"C4755 0 setuid", "C4755 0 setuid"},
+		{"D0755 0 dir", "D0755 0 dir"},
+		{"E", "E"},
+		{"T1234567890 123456 1234567891 0", "T1234567890 123456 1234567891 0"},
+		{"", ""},
+		{"E extra", ""},
+		{"C644 12 file.txt", ""},
+		{"C0948 12 file.txt", ""},
+		{"C0644 -1 file.txt", ""},
+		{"C0644 12", ""},
+		{"C0644 12 ", ""},
+		{"C0644 12 ..", ""},
+		{"C0644 12 ../file.txt", ""},
+		{"T1 2 3", ""},
+		{"T1 1000000 3 0", ""},
+		{"X0644 12 file.txt", ""},
+	}
+
+	for _, test := range tests {
+		m, err := ParseMessage(test.line)
+		if test.want == "" {
+			if _, ok := err.(*ProtocolError); !ok {
+				t.Errorf("ParseMessage(%q) = %q, %v; want a protocol error", test.line, m, err)
+			}
+			continue
+		}
+		if err != nil || m.String() != test.want {
+			t.Errorf("ParseMessage(%q) = %q, %v; want %q", test.line, m, err, test.want)
+		}
+	}
+}
+
+func TestParseRemoteError(t *testing.T) {
+	_, err := ParseMessage("\001scp: file.txt: No such file or directory")
+	rerr, ok := err.(*RemoteError)
+	if !ok || rerr.Fatal || rerr.Msg != "scp: file.txt: No such file or directory" {
+		t.Errorf("Got %#v, want a non fatal remote error", err)
+	}
+	_, err = ParseMessage("\002scp: protocol error")
+	if rerr, ok := err.(*RemoteError); !ok || !rerr.Fatal {
+		t.Errorf("Got %#v, want a fatal remote error", err)
+	}
+}
+
+func TestTimesMessageRoundTrip(t *testing.T) {
+	for _, ts := range []time.Time{time.Unix(0, 0), time.Unix(1500000000, 1000), time.Unix(1500000000, 999999999), time.Unix(4102444800, 500)} {
+		sent := TimesMessage(ts, ts.Add(time.Second/3))
+		m, err := ParseMessage(sent.String())
+		if err != nil {
+			t.Errorf("%q: %v", sent, err)
+			continue
+		}
+		// Anything under a microsecond is lost on the way
+		if !m.Mtime.Equal(ts.Truncate(time.Microsecond)) || !m.Atime.Equal(ts.Add(time.Second/3).Truncate(time.Microsecond)) {
+			t.Errorf("%q: got mtime %v and atime %v", sent, m.Mtime, m.Atime)
+		}
+	}
+}
+
+func writeTestFile(t *testing.T, path string, contents string, mode os.FileMode, mtime time.Time) {
+	err := os.WriteFile(path, []byte(contents), mode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chtimes(path, mtime, mtime)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSendReceive(t *testing.T) {
+	src := t.TempDir()
+	dst := t.TempDir()
+
+	mtime := time.Unix(1500000000, 123456000)
+	err := os.Mkdir(filepath.Join(src, "dir"), 0750)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(src, "dir", "name with spaces.txt"), "hello", 0640, mtime)
+	writeTestFile(t, filepath.Join(src, "dir", "big.bin"), string(bytes.Repeat([]byte("0123456789"), 100000)), 0600, mtime)
+	err = os.Chtimes(filepath.Join(src, "dir"), mtime, mtime)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, b := net.Pipe()
+	opts := Options{Recursive: true, Preserve: true}
+	sent := make(chan error, 1)
+	go func() {
+		sent <- Send(NewConn(a), []string{filepath.Join(src, "dir"), filepath.Join(src, "missing")}, opts)
+		a.Close()
+	}()
+	// The missing file gets reported on both ends, but everything else is still copied
+	err = Receive(NewConn(b), dst, opts)
+	if rerr, ok := err.(*RemoteError); !ok || rerr.Fatal {
+		t.Errorf("Got %#v from Receive, want a non fatal remote error", err)
+	}
+	if err := <-sent; !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Got %v from Send, want a missing file error", err)
+	}
+
+	for _, name := range []string{"dir", "dir/name with spaces.txt", "dir/big.bin"} {
+		want, err := os.Stat(filepath.Join(src, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := os.Stat(filepath.Join(dst, name))
+		if err != nil {
+			t.Errorf("%s wasn't received: %v", name, err)
+			continue
+		}
+		if got.Mode() != want.Mode() || got.Size() != want.Size() && !want.IsDir() {
+			t.Errorf("%s: got mode %v and size %d, want %v and %d", name, got.Mode(), got.Size(), want.Mode(), want.Size())
+		}
+		if !got.ModTime().Equal(mtime) {
+			t.Errorf("%s: got mtime %v, want %v", name, got.ModTime(), mtime)
+		}
+	}
+	data, err := os.ReadFile(filepath.Join(dst, "dir", "name with spaces.txt"))
+	if err != nil || string(data) != "hello" {
+		t.Errorf("Got contents %q, %v; want %q", data, err, "hello")
+	}
+}
+
+// File kept in memory, that only shows up in files once committed
+type memFile struct {
+	bytes.Buffer
+	name    string
+	files   map[string]string
+	aborted *[]string
+}
+
+func (f *memFile) Commit() error {
+	f.files[f.name] = f.String()
+	return nil
+}
+
+func (f *memFile) Abort(err error) {
+	*f.aborted = append(*f.aborted, f.name)
+}
+
+func TestReceiveWith(t *testing.T) {
+	src := t.TempDir()
+	dst := t.TempDir()
+	for _, dir := range []string{filepath.Join(src, "dir", "sub"), filepath.Join(dst, "up")} {
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeTestFile(t, filepath.Join(src, "dir", "a"), "a", 0644, time.Now())
+	writeTestFile(t, filepath.Join(src, "dir", "b"), "b", 0644, time.Now())
+	writeTestFile(t, filepath.Join(src, "dir", "sub", "c"), "c", 0644, time.Now())
+
+	files := make(map[string]string)
+	var dirs, finished, aborted []string
+	refused := errors.New("refused")
+	hooks := ReceiveHooks{
+		// Names are relative to dst here
+		Path: func(name string) (string, error) {
+			return filepath.Join(dst, name), nil
+		},
+		Mkdir: func(name string, path string, m Message) (bool, error) {
+			dirs = append(dirs, name)
+			return true, os.Mkdir(path, 0755)
+		},
+		FinishDir: func(name string, path string, m Message, created bool) error {
+			finished = append(finished, name)
+			return nil
+		},
+		Create: func(name string, path string, m Message) (File, error) {
+			if filepath.Base(name) == "b" {
+				return nil, refused
+			}
+			return &memFile{name: filepath.ToSlash(name), files: files, aborted: &aborted}, nil
+		},
+	}
+
+	a, b := net.Pipe()
+	opts := Options{Recursive: true}
+	sent := make(chan error, 1)
+	go func() {
+		sent <- Send(NewConn(a), []string{filepath.Join(src, "dir")}, opts)
+		a.Close()
+	}()
+	err := ReceiveWith(NewConn(b), "up", opts, hooks)
+	if err != refused {
+		t.Errorf("Got %v from ReceiveWith, want the error from Create", err)
+	}
+	if err := <-sent; err == nil {
+		t.Errorf("Expected Send to hear about the refused file")
+	}
+
+	// Nothing gets stored by ReceiveWith itself
+	if entries, _ := os.ReadDir(filepath.Join(dst, "up", "dir")); len(entries) != 1 || entries[0].Name() != "sub" {
+		t.Errorf("Expected only the sub directory in dst, got %v", entries)
+	}
+	if len(files) != 2 || files["up/dir/a"] != "a" || files["up/dir/sub/c"] != "c" || len(aborted) > 0 {
+		t.Errorf("Unexpected files %v, aborted %v", files, aborted)
+	}
+	if len(dirs) != 2 || len(finished) != 2 || filepath.ToSlash(finished[0]) != "up/dir/sub" {
+		t.Errorf("Unexpected directories %v, finished %v", dirs, finished)
+	}
+}
+
+func TestSendWith(t *testing.T) {
+	src := t.TempDir()
+	dst := t.TempDir()
+	err := os.MkdirAll(filepath.Join(src, "dir", "sub"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(src, "dir", "a"), "a", 0644, time.Now())
+	writeTestFile(t, filepath.Join(src, "dir", ".hidden"), "h", 0644, time.Now())
+	writeTestFile(t, filepath.Join(src, "dir", "sub", "c"), "c", 0644, time.Now())
+
+	recorded := make(map[string]error)
+	refused := errors.New("refused")
+	hooks := SendHooks{
+		// Names are relative to src here
+		Path: func(name string) (string, error) {
+			if name == "outside" {
+				return "", os.ErrNotExist
+			}
+			return filepath.Join(src, name), nil
+		},
+		Filter: func(name string) bool {
+			return !strings.HasPrefix(filepath.Base(name), ".")
+		},
+		Open: func(name string, path string, f *os.File, m Message) (io.Reader, error) {
+			if filepath.Base(name) == "c" {
+				return nil, refused
+			}
+			return strings.NewReader("A"), nil
+		},
+		Record: func(name string, path string, n int64, err error) {
+			recorded[filepath.ToSlash(name)] = err
+		},
+	}
+
+	a, b := net.Pipe()
+	opts := Options{Recursive: true}
+	received := make(chan error, 1)
+	go func() {
+		received <- Receive(NewConn(b), dst, opts)
+		b.Close()
+	}()
+	err = SendWith(NewConn(a), []string{"dir", "outside"}, opts, hooks)
+	a.Close()
+	if err != refused {
+		t.Errorf("Got %v from SendWith, want the error from Open", err)
+	}
+	if err := <-received; err == nil {
+		t.Errorf("Expected Receive to hear about the refused file")
+	}
+
+	// Whatever Open returns is what gets sent
+	data, err := os.ReadFile(filepath.Join(dst, "dir", "a"))
+	if err != nil || string(data) != "A" {
+		t.Errorf("Expected A to be received, got %q, %v", data, err)
+	}
+	for _, name := range []string{".hidden", filepath.Join("sub", "c")} {
+		if _, err := os.Stat(filepath.Join(dst, "dir", name)); !os.IsNotExist(err) {
+			t.Errorf("Expected %s not to be sent, got %v", name, err)
+		}
+	}
+	if len(recorded) != 2 || recorded["dir/a"] != nil || recorded["dir/sub/c"] != refused {
+		t.Errorf("Unexpected files recorded %v", recorded)
+	}
+}
+
+func TestReceiveExpected(t *testing.T) {
+	src := t.TempDir()
+	writeTestFile(t, filepath.Join(src, "file.txt"), "ok", 0644, time.Now())
+	writeTestFile(t, filepath.Join(src, ".bashrc"), "evil", 0644, time.Now())
+
+	tests := []struct {
+		expected []string
+		sent     string
+		ok       bool
+	}{
+		{[]string{"dir/file.txt"}, "file.txt", true},
+		{[]string{"dir/*.txt"}, "file.txt", true},
+		{[]string{"."}, ".bashrc", true},
+		{nil, ".bashrc", true},
+		// A server that sends something else than what it was asked for
+		{[]string{"dir/file.txt"}, ".bashrc", false},
+		{[]string{"*.txt", "other"}, ".bashrc", false},
+	}
+	for _, test := range tests {
+		dst := t.TempDir()
+		a, b := net.Pipe()
+		sent := make(chan error, 1)
+		go func() {
+			sent <- Send(NewConn(a), []string{filepath.Join(src, test.sent)}, Options{})
+			a.Close()
+		}()
+		err := ReceiveWith(NewConn(b), dst, Options{TargetIsDir: true}, ReceiveHooks{Expected: test.expected})
+		b.Close()
+		<-sent
+
+		_, serr := os.Stat(filepath.Join(dst, test.sent))
+		if test.ok && (err != nil || serr != nil) {
+			t.Errorf("%v: expected %s to be received, got %v, %v", test.expected, test.sent, err, serr)
+		}
+		if !test.ok && (err != ErrUnexpectedName || !os.IsNotExist(serr)) {
+			t.Errorf("%v: expected %s to be refused, got %v, %v", test.expected, test.sent, err, serr)
+		}
+	}
+}
@@ -0,0 +1,324 @@
+package scp
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"syscall"
+)
+
+// ErrUnexpectedEnd is an E message that doesn't match any D message
+var ErrUnexpectedEnd = &ProtocolError{"unexpected E message"}
+
+// ErrUnexpectedName is a file or directory sent by the other end that doesn't match what was asked for
+var ErrUnexpectedName = &ProtocolError{"filename does not match request"}
+
+// File is where Receive stores the contents of a file
+type File interface {
+	io.Writer
+	// Commit is called once the whole file has been received, to put it in place
+	Commit() error
+	// Abort is called instead if the file didn't make it, including when Commit fails
+	Abort(err error)
+}
+
+// ReceiveHooks let the caller of ReceiveWith decide where and how things are stored. Every hook
+// gets the name of what it's about as the other end knows it (target, or a path relative to it),
+// and the path it's stored at. Nil hooks do the same as "scp -t".
+type ReceiveHooks struct {
+	// Path maps a name to where it's stored
+	Path func(name string) (string, error)
+	// Mkdir creates the directory announced by m, or checks it's already there. It returns whether
+	// it had to create it
+	Mkdir func(name string, path string, m Message) (bool, error)
+	// FinishDir is called once everything in a directory has been received
+	FinishDir func(name string, path string, m Message, created bool) error
+	// Create opens the file announced by m. Files it returns an error for are skipped
+	Create func(name string, path string, m Message) (File, error)
+	// Report is told about everything wrong with what the other end sends: errors it reports,
+	// protocol errors and names that can't be stored here
+	Report func(err error)
+	// Expected are the paths (or glob patterns) asked from the other end, if it was asked for anything.
+	// Files and directories it sends that don't match the base name of any of them end the transfer,
+	// so it can't store anything else than what it was asked for
+	Expected []string
+}
+
+// Receive stores files sent by the other end under target, like "scp -t" does.
+// If target is an existing directory everything goes inside it, otherwise whatever is received
+// is stored as target. Files that can't be stored are reported to the other end and skipped.
+// The first error found is returned.
+func Receive(c *Conn, target string, opts Options) error {
+	return ReceiveWith(c, target, opts, ReceiveHooks{})
+}
+
+// ReceiveWith works like Receive, going through hooks for anything that touches the file system
+func ReceiveWith(c *Conn, target string, opts Options, hooks ReceiveHooks) error {
+	h := hooks.withDefaults(opts)
+
+	var targetIsDir bool
+	path, err := h.Path(target)
+	if err == nil {
+		fi, serr := os.Stat(path)
+		targetIsDir = serr == nil && fi.IsDir()
+		if opts.TargetIsDir && !targetIsDir {
+			err = &os.PathError{Op: "receive", Path: target, Err: syscall.ENOTDIR}
+		}
+	}
+	if err != nil {
+		// Nothing can be received, so there's no point in the other end going on
+		_, msg := WireError(target, err)
+		c.SendFatal(msg)
+		return err
+	}
+
+	// Tell the other end we're ready
+	err = c.SendOK()
+	if err != nil {
+		return err
+	}
+
+	// Directories being received, and the messages that announced them
+	type receivingDir struct {
+		name    string
+		path    string
+		msg     Message
+		created bool
+	}
+	var dirs []receivingDir
+	var firstErr error
+	fail := func(err error) {
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	for {
+		m, err := c.ReceiveMessage()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var perr *ProtocolError
+			var rerr *RemoteError
+			if errors.As(err, &perr) || errors.As(err, &rerr) {
+				h.Report(err)
+			}
+			if perr != nil {
+				c.SendError("", err)
+				return err
+			}
+			if isFatal(c, err) {
+				return err
+			}
+			// The other end couldn't send something, but will carry on with the rest
+			fail(err)
+			continue
+		}
+
+		if len(dirs) == 0 && m.Type != MsgEndDir && !expectedName(h.Expected, m.Name) {
+			h.Report(ErrUnexpectedName)
+			c.SendError("", ErrUnexpectedName)
+			return ErrUnexpectedName
+		}
+
+		var name string
+		switch {
+		case m.Type == MsgEndDir:
+		case len(dirs) == 0 && !targetIsDir:
+			name = target
+		case !LocalName(m.Name):
+			// Only a file name for the other end, here it could take us anywhere. It will skip it
+			err := &os.PathError{Op: "receive", Path: m.Name, Err: os.ErrInvalid}
+			h.Report(err)
+			fail(err)
+			c.SendError(m.Name, err)
+			continue
+		case len(dirs) > 0:
+			name = filepath.Join(dirs[len(dirs)-1].name, m.Name)
+		default:
+			name = filepath.Join(target, m.Name)
+		}
+		var path string
+		if len(name) > 0 {
+			path, err = h.Path(name)
+		}
+		if err != nil {
+			fail(err)
+			c.SendError(name, err)
+			continue
+		}
+
+		switch m.Type {
+		case MsgEndDir:
+			if len(dirs) == 0 {
+				h.Report(ErrUnexpectedEnd)
+				c.SendError("", ErrUnexpectedEnd)
+				return ErrUnexpectedEnd
+			}
+			dir := dirs[len(dirs)-1]
+			dirs = dirs[:len(dirs)-1]
+			err = h.FinishDir(dir.name, dir.path, dir.msg, dir.created)
+			if err != nil {
+				fail(err)
+				c.SendError(dir.name, err)
+				continue
+			}
+			c.SendOK()
+		case MsgDir:
+			if !opts.Recursive {
+				err := &ProtocolError{"received directory without -r"}
+				h.Report(err)
+				c.SendError("", err)
+				return err
+			}
+			created, err := h.Mkdir(name, path, m)
+			if err != nil {
+				// The other end will skip the whole directory
+				fail(err)
+				c.SendError(name, err)
+				continue
+			}
+			dirs = append(dirs, receivingDir{name: name, path: path, msg: m, created: created})
+			c.SendOK()
+		case MsgFile:
+			err = receiveFile(c, name, path, m, h)
+			if err != nil {
+				if isFatal(c, err) {
+					return err
+				}
+				fail(err)
+			}
+		}
+		if c.Err() != nil {
+			return c.Err()
+		}
+	}
+	return firstErr
+}
+
+// Fill in the hooks that weren't set with what "scp -t" does
+func (h ReceiveHooks) withDefaults(opts Options) ReceiveHooks {
+	if h.Path == nil {
+		h.Path = func(name string) (string, error) { return name, nil }
+	}
+	if h.Mkdir == nil {
+		h.Mkdir = func(name string, path string, m Message) (bool, error) { return createDir(path, m.Mode) }
+	}
+	if h.FinishDir == nil {
+		h.FinishDir = func(name string, path string, m Message, created bool) error { return finishFile(path, m, opts) }
+	}
+	if h.Create == nil {
+		h.Create = func(name string, path string, m Message) (File, error) { return createFile(path, m, opts) }
+	}
+	if h.Report == nil {
+		h.Report = func(err error) {}
+	}
+	return h
+}
+
+// Whether name matches the base name of any of the expected paths. Anything matches if nothing is expected,
+// or if a path doesn't say what's in it (like ".")
+func expectedName(expected []string, name string) bool {
+	if len(expected) == 0 {
+		return true
+	}
+	for _, p := range expected {
+		base := path.Base(p)
+		if base == "." || base == ".." || base == "/" {
+			return true
+		}
+		matched, err := path.Match(base, name)
+		if matched || (err != nil && base == name) {
+			return true
+		}
+	}
+	return false
+}
+
+func createDir(path string, mode os.FileMode) (bool, error) {
+	fi, err := os.Stat(path)
+	if err == nil && fi.IsDir() {
+		return false, nil
+	}
+	// We need to be able to write in it until everything has been received
+	err = os.Mkdir(path, mode|0700)
+	return err == nil, err
+}
+
+// Receive a file announced by m and store it in path
+func receiveFile(c *Conn, name string, path string, m Message, h ReceiveHooks) error {
+	f, err := h.Create(name, path, m)
+	if err != nil {
+		c.SendError(name, err)
+		return err
+	}
+
+	err = c.SendOK()
+	if err != nil {
+		f.Abort(err)
+		return err
+	}
+	_, err = c.ReadFile(m, f)
+	var rerr *RemoteError
+	if errors.As(err, &rerr) {
+		// The other end already knows something went wrong
+		h.Report(err)
+		f.Abort(err)
+		c.SendOK()
+		return err
+	}
+	if err == nil {
+		err = f.Commit()
+	}
+	if err != nil {
+		f.Abort(err)
+		c.SendError(name, err)
+		return err
+	}
+	return c.SendOK()
+}
+
+// File stored as is, the way "scp -t" does
+type plainFile struct {
+	*os.File
+	m    Message
+	opts Options
+}
+
+func createFile(path string, m Message, opts Options) (File, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, m.Mode&os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	return plainFile{File: f, m: m, opts: opts}, nil
+}
+
+func (f plainFile) Commit() error {
+	err := f.Close()
+	if err != nil {
+		return err
+	}
+	return finishFile(f.Name(), f.m, f.opts)
+}
+
+func (f plainFile) Abort(err error) {
+	f.Close()
+}
+
+// Apply mode and times sent by the other end to a file or directory that's been completely received
+func finishFile(path string, m Message, opts Options) error {
+	if !opts.Preserve {
+		return nil
+	}
+	err := os.Chmod(path, m.Mode)
+	if err != nil {
+		return err
+	}
+	if m.HasTimes() {
+		return os.Chtimes(path, m.Atime, m.Mtime)
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+package scp
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// FileTimes returns the modification and access times of the file at path, as sent in a T message.
+// fi is what os.Stat returns for it.
+func FileTimes(path string, fi os.FileInfo) (mtime time.Time, atime time.Time) {
+	return fi.ModTime(), accessTime(path, fi)
+}
+
+// Whether the transfer can't go on after err
+func isFatal(c *Conn, err error) bool {
+	var rerr *RemoteError
+	return c.Err() != nil || (errors.As(err, &rerr) && rerr.Fatal)
+}
+
+// SendHooks let the caller of SendWith decide what is sent and keep track of it. Every hook gets the
+// name of what it's about as the other end knows it (one of the paths passed to SendWith, or a path
+// inside one of them), and the path it's read from. Nil hooks do the same as "scp -f".
+type SendHooks struct {
+	// Path maps a name to where it's read from
+	Path func(name string) (string, error)
+	// Filter decides which entries of a directory are sent, by name. The rest are skipped without a word
+	Filter func(name string) bool
+	// Open returns what to send as the contents of the file announced by m, given the file itself
+	Open func(name string, path string, f *os.File, m Message) (io.Reader, error)
+	// Record is told how sending each file went: how many bytes of it were sent, and the error if it wasn't
+	// sent whole. Only files that made it past Path get recorded, and never directories
+	Record func(name string, path string, n int64, err error)
+	// Report is told about every error the other end reports
+	Report func(err error)
+}
+
+// Send sends local files (and directories, if opts.Recursive is set) to the other end, like "scp -f" does.
+// Files that can't be sent are reported to the other end and skipped. The first error found is returned.
+func Send(c *Conn, paths []string, opts Options) error {
+	return SendWith(c, paths, opts, SendHooks{})
+}
+
+// SendWith works like Send, going through hooks for anything that touches the file system
+func SendWith(c *Conn, names []string, opts Options, hooks SendHooks) error {
+	h := hooks.withDefaults()
+	s := sender{c: c, opts: opts, h: h}
+
+	// The other end tells us when it's ready
+	err := s.remote(c.ReadStatus())
+	if err != nil {
+		return err
+	}
+
+	var firstErr error
+	for _, name := range names {
+		path, err := h.Path(name)
+		if err == nil {
+			err = s.sendPath(name, path)
+		} else {
+			c.SendError(name, err)
+		}
+		if err == nil {
+			continue
+		}
+		if isFatal(c, err) {
+			return err
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Fill in the hooks that weren't set with what "scp -f" does
+func (h SendHooks) withDefaults() SendHooks {
+	if h.Path == nil {
+		h.Path = func(name string) (string, error) { return name, nil }
+	}
+	if h.Filter == nil {
+		h.Filter = func(name string) bool { return true }
+	}
+	if h.Open == nil {
+		h.Open = func(name string, path string, f *os.File, m Message) (io.Reader, error) { return f, nil }
+	}
+	if h.Record == nil {
+		h.Record = func(name string, path string, n int64, err error) {}
+	}
+	if h.Report == nil {
+		h.Report = func(err error) {}
+	}
+	return h
+}
+
+// State of a SendWith call
+type sender struct {
+	c    *Conn
+	opts Options
+	h    SendHooks
+}
+
+// Pass on err, after reporting it if the other end sent it
+func (s sender) remote(err error) error {
+	var rerr *RemoteError
+	if errors.As(err, &rerr) {
+		s.h.Report(err)
+	}
+	return err
+}
+
+// Tell the other end we're skipping name because of err, and record it
+func (s sender) skip(name string, path string, err error) error {
+	s.h.Record(name, path, 0, err)
+	s.c.SendError(name, err)
+	return err
+}
+
+func (s sender) sendPath(name string, path string) error {
+	// Only open what can be sent: opening a named pipe would wait for someone to write to it
+	fi, err := os.Stat(path)
+	if err == nil && !fi.Mode().IsRegular() && !(fi.IsDir() && s.opts.Recursive) {
+		err = &os.PathError{Op: "send", Path: path, Err: ErrNotRegular}
+	}
+	if err != nil {
+		return s.skip(name, path, err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return s.skip(name, path, err)
+	}
+	defer f.Close()
+
+	fi, err = f.Stat()
+	if err != nil {
+		return s.skip(name, path, err)
+	}
+	if fi.IsDir() && s.opts.Recursive {
+		return s.sendDir(name, f, fi)
+	}
+	if !fi.Mode().IsRegular() {
+		return s.skip(name, path, &os.PathError{Op: "send", Path: path, Err: ErrNotRegular})
+	}
+
+	m := FileMessage(fi.Name(), fi.Mode(), fi.Size())
+	r, err := s.h.Open(name, path, f, m)
+	if err != nil {
+		return s.skip(name, path, err)
+	}
+	if s.opts.Preserve {
+		err = s.remote(s.c.SendMessage(TimesMessage(FileTimes(path, fi))))
+	}
+	if err == nil {
+		err = s.remote(s.c.SendMessage(m))
+	}
+	if err != nil {
+		// The other end won't take the file, and already knows why
+		s.h.Record(name, path, 0, err)
+		return err
+	}
+	n, err := s.c.WriteFile(m, r)
+	s.h.Record(name, path, n, s.remote(err))
+	return err
+}
+
+func (s sender) sendDir(name string, dir *os.File, fi os.FileInfo) error {
+	var err error
+	if s.opts.Preserve {
+		err = s.remote(s.c.SendMessage(TimesMessage(FileTimes(dir.Name(), fi))))
+	}
+	if err == nil {
+		err = s.remote(s.c.SendMessage(DirMessage(fi.Name(), fi.Mode())))
+	}
+	if err != nil {
+		// The other end won't take anything in this directory
+		return err
+	}
+
+	var firstErr error
+	entries, err := dir.Readdirnames(0)
+	if err != nil {
+		// Send whatever could be listed, the other end gets told about the rest
+		s.c.SendError(name, err)
+		firstErr = err
+	}
+	for _, entry := range entries {
+		entryName := filepath.Join(name, entry)
+		if !s.h.Filter(entryName) {
+			continue
+		}
+		path, err := s.h.Path(entryName)
+		if err == nil {
+			err = s.sendPath(entryName, path)
+		} else {
+			s.c.SendError(entryName, err)
+		}
+		if err == nil {
+			continue
+		}
+		if isFatal(s.c, err) {
+			return err
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	err = s.remote(s.c.SendMessage(EndDirMessage()))
+	if err != nil {
+		return err
+	}
+	return firstErr
+}
@@ -0,0 +1,13 @@
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris,!windows
+
+package scp
+
+import (
+	"os"
+	"time"
+)
+
+// No portable way to get the access time here, so make do with the modification time
+func accessTime(path string, fi os.FileInfo) time.Time {
+	return fi.ModTime()
+}
@@ -0,0 +1,20 @@
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package scp
+
+import (
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// os.FileInfo only has the modification time, and where syscall keeps the access time changes
+// from system to system, so ask for it again through x/sys, which has the same Stat_t everywhere
+func accessTime(path string, fi os.FileInfo) time.Time {
+	var stat unix.Stat_t
+	if unix.Stat(path, &stat) != nil {
+		return fi.ModTime()
+	}
+	return time.Unix(stat.Atim.Unix())
+}
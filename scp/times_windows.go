@@ -0,0 +1,18 @@
+// +build windows
+
+package scp
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// Windows keeps the access time along with the rest of the file's attributes, which is what os.Stat returns
+func accessTime(path string, fi os.FileInfo) time.Time {
+	attrs, ok := fi.Sys().(*syscall.Win32FileAttributeData)
+	if !ok {
+		return fi.ModTime()
+	}
+	return time.Unix(0, attrs.LastAccessTime.Nanoseconds())
+}
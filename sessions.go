@@ -0,0 +1,170 @@
+package main
+
+import (
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Progress of a file being transferred right now
+type transferProgress struct {
+	path      string
+	direction string // "upload" or "download"
+	size      int64
+	started   time.Time
+	bytes     atomic.Int64
+}
+
+// Writer that keeps track of how much has gone through it
+type progressWriter struct {
+	w        io.Writer
+	progress *transferProgress
+}
+
+func (p progressWriter) Write(data []byte) (int, error) {
+	n, err := p.w.Write(data)
+	p.progress.bytes.Add(int64(n))
+	return n, err
+}
+
+// Mark the start of a transfer in conn, returning a writer that updates its progress as data goes through w.
+// Each channel can be transferring a file at the same time, so every transfer has to be ended on its own.
+func (conn *connState) startTransfer(direction string, path string, size int64, w io.Writer) (io.Writer, *transferProgress) {
+	progress := &transferProgress{path: path, direction: direction, size: size, started: time.Now()}
+	conn.transfersMu.Lock()
+	defer conn.transfersMu.Unlock()
+	if conn.transfers == nil {
+		conn.transfers = make(map[*transferProgress]struct{})
+	}
+	conn.transfers[progress] = struct{}{}
+	return progressWriter{w: w, progress: progress}, progress
+}
+
+func (conn *connState) endTransfer(progress *transferProgress) {
+	conn.transfersMu.Lock()
+	defer conn.transfersMu.Unlock()
+	delete(conn.transfers, progress)
+}
+
+// Files being transferred right now, oldest first
+func (conn *connState) activeTransfers() []*transferProgress {
+	conn.transfersMu.Lock()
+	transfers := make([]*transferProgress, 0, len(conn.transfers))
+	for p := range conn.transfers {
+		transfers = append(transfers, p)
+	}
+	conn.transfersMu.Unlock()
+
+	sort.Slice(transfers, func(i, j int) bool { return transfers[i].started.Before(transfers[j].started) })
+	return transfers
+}
+
+// Canonical form of an IP, so the same address always looks the same (e.g. IPv4-mapped IPv6 addresses, or leading zeros)
+func normalizeIP(ip string) string {
+	if parsed := net.ParseIP(ip); parsed != nil {
+		return parsed.String()
+	}
+	return ip
+}
+
+// Keeps track of every open connection, and of the IPs we don't want connections from
+type sessionRegistry struct {
+	mu        sync.Mutex
+	conns     map[string]*connState
+	bannedIPs map[string]time.Time
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{
+		conns:     make(map[string]*connState),
+		bannedIPs: make(map[string]time.Time),
+	}
+}
+
+func (r *sessionRegistry) add(conn *connState) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.conns[conn.sessionID] = conn
+}
+
+func (r *sessionRegistry) remove(conn *connState) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.conns, conn.sessionID)
+}
+
+// All open connections, oldest first
+func (r *sessionRegistry) list() []*connState {
+	r.mu.Lock()
+	conns := make([]*connState, 0, len(r.conns))
+	for _, conn := range r.conns {
+		conns = append(conns, conn)
+	}
+	r.mu.Unlock()
+
+	sort.Slice(conns, func(i, j int) bool { return conns[i].started.Before(conns[j].started) })
+	return conns
+}
+
+// Close the connection with the given session id. Returns false if there's no such session
+func (r *sessionRegistry) kill(sessionID string) bool {
+	r.mu.Lock()
+	conn, ok := r.conns[sessionID]
+	r.mu.Unlock()
+	if !ok {
+		return false
+	}
+	conn.log.Warn("Killing session")
+	conn.sshConn.Close()
+	return true
+}
+
+// Refuse any further connections from ip, and close the ones it already has open
+func (r *sessionRegistry) ban(ip string) {
+	ip = normalizeIP(ip)
+	r.mu.Lock()
+	r.bannedIPs[ip] = time.Now()
+	var toKill []string
+	for id, conn := range r.conns {
+		if conn.clientIP() == ip {
+			toKill = append(toKill, id)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, id := range toKill {
+		r.kill(id)
+	}
+}
+
+// Lift a ban. Returns false if ip wasn't banned
+func (r *sessionRegistry) unban(ip string) bool {
+	ip = normalizeIP(ip)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.bannedIPs[ip]
+	delete(r.bannedIPs, ip)
+	return ok
+}
+
+func (r *sessionRegistry) isBanned(ip string) bool {
+	ip = normalizeIP(ip)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.bannedIPs[ip]
+	return ok
+}
+
+// Banned IPs, and when they were banned
+func (r *sessionRegistry) bans() map[string]time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	bans := make(map[string]time.Time, len(r.bannedIPs))
+	for ip, t := range r.bannedIPs {
+		bans[ip] = t
+	}
+	return bans
+}
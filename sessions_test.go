@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+func TestBansNormalizeIPs(t *testing.T) {
+	r := newSessionRegistry()
+	r.ban("::ffff:192.0.2.1")
+	r.ban("2001:DB8:0:0::1")
+
+	for _, ip := range []string{"192.0.2.1", "::ffff:192.0.2.1", "2001:db8::1", "2001:0db8::0001"} {
+		if !r.isBanned(ip) {
+			t.Errorf("Expected %s to be banned", ip)
+		}
+	}
+	if r.isBanned("192.0.2.2") {
+		t.Errorf("Unexpected ban for 192.0.2.2")
+	}
+	if bans := r.bans(); len(bans) != 2 {
+		t.Errorf("Expected 2 bans, got %v", bans)
+	}
+
+	if !r.unban("2001:db8::1") || r.isBanned("2001:DB8::1") {
+		t.Errorf("Expected the ban to be lifted whatever way the IP is written")
+	}
+
+	conn := &connState{remoteAddr: &net.TCPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 22}}
+	if ip := conn.clientIP(); ip != "192.0.2.1" {
+		t.Errorf("Expected client IP 192.0.2.1, got %s", ip)
+	}
+}
+
+func TestConcurrentTransfers(t *testing.T) {
+	conn := &connState{remoteAddr: &net.TCPAddr{}}
+	w1, upload := conn.startTransfer("upload", "a", 10, io.Discard)
+	w2, download := conn.startTransfer("download", "b", 20, io.Discard)
+	io.WriteString(w1, "hello")
+	io.WriteString(w2, "hi")
+
+	info := describeSession(conn)
+	progress := make(map[string]int64)
+	for _, transfer := range info.Transfers {
+		progress[transfer.Path] = transfer.Bytes
+	}
+	if len(info.Transfers) != 2 || progress["a"] != 5 || progress["b"] != 2 {
+		t.Errorf("Unexpected transfers %+v", info.Transfers)
+	}
+
+	// Ending one leaves the other alone
+	conn.endTransfer(upload)
+	transfers := conn.activeTransfers()
+	if len(transfers) != 1 || transfers[0] != download {
+		t.Errorf("Expected only the download left, got %+v", transfers)
+	}
+	conn.endTransfer(download)
+	if transfers := conn.activeTransfers(); len(transfers) != 0 {
+		t.Errorf("Expected no transfers left, got %+v", transfers)
+	}
+}
@@ -1,27 +1,28 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"log"
+	"log/slog"
 	"net"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
-	"github.com/FranGM/simplelog"
-	"github.com/flynn/go-shlex"
+	"github.com/FranGM/simplescp/scp"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/time/rate"
 )
 
-type scpOptions struct {
-	To           bool
-	From         bool
-	TargetIsDir  bool
-	Recursive    bool
-	PreserveMode bool
-	fileNames    []string
-}
-
 type scpConfig struct {
 	User           string
 	passwords      map[string]string
+	PasswordFile   string // Where to write the generated password to, if one is generated
 	Dir            string
 	privateKey     ssh.Signer
 	PrivateKeyFile string
@@ -29,6 +30,89 @@ type scpConfig struct {
 	AuthKeys       map[string][]ssh.PublicKey
 	AuthKeysFile   string
 	OneShot        bool // Serve just one connection, then quit (useful for tests)
+	RateLimit      int  // Bandwidth limit (in Kbit/s) shared by all connections
+	UserRateLimits map[string]int
+	ConnRateLimit  int // Bandwidth limit (in Kbit/s) for each individual connection
+	globalLimiter  *rate.Limiter
+	userLimiters   map[string]*rate.Limiter
+	QuotaBytes     int64 // Most bytes a user's root can hold, unless they have their own quota
+	QuotaFiles     int64 // Most files a user's root can hold, unless they have their own quota
+	UserQuotaBytes map[string]int64
+	UserQuotaFiles map[string]int64
+	MinFreeSpace   uint64 // Free bytes that uploads must leave on the target filesystem
+	MaxFileSize    uint64 // Biggest file we'll accept in an upload
+	AllowedFiles   []string
+	DeniedFiles    []string
+	// What to do with uploads to files that already exist (overwrite, refuse, rename or version)
+	OverwritePolicy       string
+	UserOverwritePolicies map[string]string
+	ResumableUploads      bool          // Keep interrupted uploads and accept simplescp-resume
+	PartialMaxAge         time.Duration // Interrupted uploads older than this are removed on startup
+	ExtraChecksum         string        // Checksum computed on transfers besides SHA-256 (blake3 or xxhash)
+	Manifest              string        // Format of the manifest written after a recursive upload (sha256 or json)
+	AuditLog              string        // File to write the audit log to, or "syslog"
+	AuditLogMaxSize       int           // Size in megabytes after which the audit log file gets rotated
+	AuditLogMaxBackups    int           // Rotated audit log files to keep
+	LogLevel              string        // debug, info, warn or error
+	LogFormat             string        // text or json
+	AdminAddr             string        // Address to serve metrics and health checks on (like ":9100")
+	AdminSocket           string        // Unix socket to serve the admin API on
+	AdminToken            string        // Token clients of the admin API need to present
+	ShutdownDelay         time.Duration // Time between failing readiness and closing the listener on shutdown
+	ShutdownTimeout       time.Duration // Time to wait for connections to finish on shutdown
+	// Command to run or URL to POST to on each event
+	HookLogin        string
+	HookLogout       string
+	HookPostUpload   string
+	HookPostDownload string
+	HookTimeout      time.Duration // Time each attempt of running a hook is allowed to take
+	HookRetries      int           // Extra attempts made when a hook fails
+	EventSpool       string        // Directory or named pipe to write an event to for every completed upload
+	Umask            string        // Permissions (in octal) taken away from what clients ask for their uploads
+	UserFileModes    map[string]string
+	UserDirModes     map[string]string
+	UploadOwner      string // User (name or uid) that uploads are handed over to
+	UploadGroup      string // Group (name or gid) that uploads are handed over to
+	umask            os.FileMode
+	userFileModes    map[string]os.FileMode
+	userDirModes     map[string]os.FileMode
+	uploadUID        int
+	uploadGID        int
+	usage            *usageCache
+	audit            *auditLogger
+	spool            *eventSpool
+	state            *serverState
+	sessions         *sessionRegistry
+}
+
+// State of an authenticated client connection, shared by all of its channels
+type connState struct {
+	sessionID      string
+	user           string
+	keyFingerprint string // Empty unless the user authenticated with a public key
+	remoteAddr     net.Addr
+	started        time.Time
+	limiters       []*rate.Limiter
+	log            *slog.Logger // Adds the session's details to everything logged
+	sshConn        ssh.Conn
+	transfersMu    sync.Mutex
+	transfers      map[*transferProgress]struct{} // Files being transferred right now, by any of the channels
+}
+
+// IP address of the client, without the port
+func (conn *connState) clientIP() string {
+	host, _, err := net.SplitHostPort(conn.remoteAddr.String())
+	if err != nil {
+		return conn.remoteAddr.String()
+	}
+	return normalizeIP(host)
+}
+
+// Random identifier used to correlate everything done in a connection
+func newSessionID() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
 }
 
 func newScpConfig() *scpConfig {
@@ -36,7 +120,23 @@ func newScpConfig() *scpConfig {
 	if err != nil {
 		log.Fatal(err)
 	}
-	return &scpConfig{Port: "2222", User: "scpuser", Dir: workingDir}
+	return &scpConfig{
+		Port:               "2222",
+		User:               "scpuser",
+		Dir:                workingDir,
+		PartialMaxAge:      7 * 24 * time.Hour,
+		AuditLogMaxSize:    100,
+		AuditLogMaxBackups: 5,
+		LogLevel:           "info",
+		LogFormat:          "text",
+		ShutdownTimeout:    30 * time.Second,
+		HookTimeout:        10 * time.Second,
+		HookRetries:        3,
+		Umask:              "022",
+		usage:              &usageCache{},
+		state:              &serverState{},
+		sessions:           newSessionRegistry(),
+	}
 }
 
 // Allows us to send to the client the exit status code of the command they asked as to run
@@ -46,22 +146,44 @@ func sendExitStatusCode(channel ssh.Channel, status uint8) {
 	_, err := channel.SendRequest("exit-status", false, exitStatusBuffer)
 	if err != nil {
 		// TODO: Don't we prefer to return the error here?
-		simplelog.Error.Printf("Failed to forward exit-status to client: %v", err)
+		slog.Error("Failed to forward exit-status to client", "err", err)
 	}
 }
 
 // Handle requests received through a channel
-func (config scpConfig) handleRequest(channel ssh.Channel, req *ssh.Request) {
+func (config scpConfig) handleRequest(channel ssh.Channel, req *ssh.Request, conn *connState) {
+	activeSessions.Inc()
+	defer activeSessions.Dec()
+
 	ok := true
-	simplelog.Debug.Printf("Payload before splitting is %v", string(req.Payload[4:]))
-	s, err := shlex.Split(string(req.Payload[4:]))
+	s, err := parseCommand(req.Payload)
 	if err != nil {
-		// TODO: Shouldn't we do something with this error?
-		simplelog.Error.Printf("Error when splitting payload: %v", err)
+		conn.log.Error("Error when parsing command", "err", err)
+		protocolErrors.WithLabelValues(errBadCommand).Inc()
+		req.Reply(true, nil)
+		fmt.Fprintf(channel.Stderr(), "%v\n", err)
+		closeChannel(channel, 1, conn.log)
+		return
+	}
+	conn.log.Debug("Received exec request", "command", s)
+
+	if _, ok := checksumCommands[s[0]]; ok {
+		req.Reply(true, nil)
+		sendExitStatusCode(channel, config.handleChecksumCommand(channel, s[0], s[1:]))
+		channel.Close()
+		return
+	}
+
+	if s[0] == resumeCommand && config.ResumableUploads {
+		req.Reply(true, nil)
+		sendExitStatusCode(channel, config.handleResume(channel, s[1:], conn))
+		channel.Close()
+		return
 	}
 
 	// Ignore everything that's not scp
 	if s[0] != "scp" {
+		protocolErrors.WithLabelValues(errUnsupportedCommand).Inc()
 		ok = false
 		req.Reply(ok, []byte("Only scp is supported"))
 		channel.Write([]byte("Only scp is supported\n"))
@@ -69,91 +191,51 @@ func (config scpConfig) handleRequest(channel ssh.Channel, req *ssh.Request) {
 		return
 	}
 
-	opts := scpOptions{}
-	// TODO: Do a sanity check of options (like needing to have either -f or -t defined)
-	// TODO: Define what happens if both -t and -f are specified?
-	// TODO: If we have more than one filename with -t defined it's an error: "ambiguous target"
-
-	// At the very least we expect either -t or -f
-	// UNDOCUMENTED scp OPTIONS:
-	//  -t: "TO", our server will be receiving files
-	//  -f: "FROM", our server will be sending files
-	//  -d: Target is expected to be a directory
-	// DOCUMENTED scp OPTIONS:
-	//  -r: Recursively copy entire directories (follows symlinks)
-	//  -p: Preserve modification mtime, atime and mode of files
-	parseOpts := true
-	opts.fileNames = make([]string, 0)
-	for _, elem := range s[1:] {
-		if parseOpts {
-			switch elem {
-			case "-f":
-				opts.From = true
-			case "-t":
-				opts.To = true
-			case "-d":
-				opts.TargetIsDir = true
-			case "-p":
-				opts.PreserveMode = true
-			case "-r":
-				opts.Recursive = true
-			case "-v":
-				// Verbose mode, this is more of a local client thing
-			case "--":
-				// After finding a "--" we stop parsing for flags
-				if parseOpts {
-					parseOpts = false
-				} else {
-					opts.fileNames = append(opts.fileNames, elem)
-				}
-			default:
-				opts.fileNames = append(opts.fileNames, elem)
-			}
-		}
+	opts, err := parseSCPOptions(s[1:])
+	if err != nil {
+		conn.log.Error("Invalid scp options", "args", s[1:], "err", err)
+		protocolErrors.WithLabelValues(errBadCommand).Inc()
+		req.Reply(true, nil)
+		fmt.Fprintf(channel.Stderr(), "scp: %v\n", err)
+		closeChannel(channel, 1, conn.log)
+		return
 	}
 
-	simplelog.Debug.Printf("Called scp with %v", s[1:])
-	simplelog.Debug.Printf("Options: %v", opts)
-	simplelog.Debug.Printf("Filenames: %v", opts.fileNames)
+	conn.log.Debug("Called scp", "args", s[1:], "options", opts, "filenames", opts.fileNames)
+
+	// The reply only tells the client scp got started, how the transfer went is up to its exit status.
+	// Clients can wait for it before starting the transfer, so it can't wait until the transfer is done.
+	req.Reply(true, nil)
 
-	// We're acting as source
 	if opts.From {
-		err := config.startSCPSource(channel, opts)
-		ok := true
-		if err != nil {
-			ok = false
-			req.Reply(ok, []byte(err.Error()))
-		} else {
-			req.Reply(ok, nil)
-		}
+		// We're acting as source
+		err = config.startSCPSource(channel, opts, conn)
+	} else if len(opts.fileNames) != 1 {
+		conn.log.Error("Error in number of targets (ambiguous target)", "targets", opts.fileNames)
+		protocolErrors.WithLabelValues(errAmbiguousTarget).Inc()
+		err = errors.New("ambiguous target")
+		scp.NewConn(channel).SendError("", err)
+	} else {
+		// We're acting as sink
+		err = config.startSCPSink(channel, opts, conn)
 	}
 
-	// We're acting as sink
-	if opts.To {
-		var statusCode uint8
-		ok := true
-		if len(opts.fileNames) != 1 {
-			simplelog.Error.Printf("Error in number of targets (ambiguous target)")
-			statusCode = 1
-			ok = false
-			sendErrorToClient("scp: ambiguous target", channel)
-		} else {
-			config.startSCPSink(channel, opts)
-		}
-		sendExitStatusCode(channel, statusCode)
-		channel.Close()
-		req.Reply(ok, nil)
-		return
+	// Same as scp, any file that didn't make it means the whole command failed
+	var exitStatus uint8
+	if err != nil {
+		conn.log.Error("Transfer finished with errors", "err", err)
+		exitStatus = 1
 	}
+	closeChannel(channel, exitStatus, conn.log)
 }
 
-func (config scpConfig) handleNewChannel(newChannel ssh.NewChannel) {
+func (config scpConfig) handleNewChannel(newChannel ssh.NewChannel, conn *connState) {
 	// There are different channel types, depending on what's done at the application level.
 	// scp is done over a "session" channel (as it's just used to execute "scp" on the remote side)
 	// We reject any other kind of channel as we only care about scp
-	simplelog.Debug.Printf("Channel type is %v", newChannel.ChannelType())
+	conn.log.Debug("New channel", "type", newChannel.ChannelType())
 	if newChannel.ChannelType() != "session" {
-		simplelog.Debug.Printf("Rejecting channel request for type %v", newChannel.ChannelType)
+		conn.log.Debug("Rejecting channel", "type", newChannel.ChannelType())
 		newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
 		return
 	}
@@ -162,6 +244,7 @@ func (config scpConfig) handleNewChannel(newChannel ssh.NewChannel) {
 		// TODO: Don't panic here, just clean up and log error
 		panic("could not accept channel.")
 	}
+	channel = throttleChannel(countingChannel{channel}, conn.limiters...)
 
 	// Inside our channel there are several kinds of requests.
 	// We can have a request to open a shell or to set environment variables
@@ -170,7 +253,7 @@ func (config scpConfig) handleNewChannel(newChannel ssh.NewChannel) {
 		// scp does an exec, so that's all we care about
 		switch req.Type {
 		case "exec":
-			go config.handleRequest(channel, req)
+			go config.handleRequest(channel, req, conn)
 		case "shell":
 			channel.Write([]byte("Opening a shell is not supported by this server\n"))
 			req.Reply(false, nil)
@@ -179,7 +262,7 @@ func (config scpConfig) handleNewChannel(newChannel ssh.NewChannel) {
 			// TODO: Is there any kind of env settings we want to honor?
 			req.Reply(true, nil)
 		default:
-			simplelog.Debug.Printf("Req type: %v, req payload: %v", req.Type, string(req.Payload))
+			conn.log.Debug("Ignoring channel request", "type", req.Type)
 			req.Reply(true, nil)
 		}
 	}
@@ -187,17 +270,49 @@ func (config scpConfig) handleNewChannel(newChannel ssh.NewChannel) {
 
 // Handle new connections
 func (c scpConfig) handleConn(nConn net.Conn, config *ssh.ServerConfig) {
-	_, chans, _, err := ssh.NewServerConn(nConn, config)
+	if host, _, err := net.SplitHostPort(nConn.RemoteAddr().String()); err == nil && c.sessions.isBanned(host) {
+		slog.Warn("Refusing connection from banned IP", "remote_addr", nConn.RemoteAddr())
+		nConn.Close()
+		return
+	}
+
+	sshConn, chans, _, err := ssh.NewServerConn(nConn, config)
 	if err != nil {
-		simplelog.Error.Printf("Error during handshake: %v", err)
+		slog.Error("Error during handshake", "remote_addr", nConn.RemoteAddr(), "err", err)
 		return
 	}
+	activeConnections.Inc()
+	defer activeConnections.Dec()
+
+	conn := &connState{
+		sessionID:  newSessionID(),
+		user:       sshConn.User(),
+		remoteAddr: sshConn.RemoteAddr(),
+		started:    time.Now(),
+		sshConn:    sshConn,
+		// All channels in this connection share its bandwidth limits
+		limiters: []*rate.Limiter{c.globalLimiter, c.userLimiters[sshConn.User()], newBandwidthLimiter(c.ConnRateLimit)},
+	}
+	if sshConn.Permissions != nil {
+		conn.keyFingerprint = sshConn.Permissions.Extensions[keyFingerprintExtension]
+	}
+	authMethod := "password"
+	if len(conn.keyFingerprint) > 0 {
+		authMethod = "publickey"
+	}
+	authAttempts.WithLabelValues(authMethod, "success").Inc()
+	conn.log = slog.With("session", conn.sessionID, "user", conn.user, "remote_addr", conn.remoteAddr.String())
+	conn.log.Info("Session started", "key_fingerprint", conn.keyFingerprint)
+	c.sessions.add(conn)
+	defer c.sessions.remove(conn)
+	c.fireHook(conn, newHookEvent(eventLogin, conn))
+	defer c.fireHook(conn, newHookEvent(eventLogout, conn))
 
 	// Handle any new channels
 	for newChannel := range chans {
-		go c.handleNewChannel(newChannel)
+		go c.handleNewChannel(newChannel, conn)
 	}
-	simplelog.Debug.Printf("Finished handling connection from %q", nConn.RemoteAddr())
+	conn.log.Info("Session finished")
 }
 
 // Parse and return a ssh public key as found in an authorized keys file
@@ -210,26 +325,65 @@ func startServer(config *scpConfig, serverConfig *ssh.ServerConfig) {
 	// TODO: Add config option/parameter to exit after the first connection (mostly for testing)
 	listener, err := net.Listen("tcp", "0.0.0.0:"+config.Port)
 	if err != nil {
-		simplelog.Fatal.Printf("Failed to listen for connections: %q", err)
+		fatal("Failed to listen for connections", "err", err)
 	}
-	simplelog.Info.Printf("Listening on port %v. Accepting connections", config.Port)
+	slog.Info("Listening for connections", "port", config.Port)
+	config.state.accepting.Store(true)
+	defer config.state.accepting.Store(false)
+
+	go config.waitForShutdown(listener)
+
+	var conns sync.WaitGroup
 	for {
 		nConn, err := listener.Accept()
 		if err != nil {
-			simplelog.Fatal.Printf("Failed to accept incoming connection: %q", err)
+			if config.state.shuttingDown.Load() {
+				break
+			}
+			fatal("Failed to accept incoming connection", "err", err)
 		}
-		simplelog.Info.Printf("Accepted connection from %v", nConn.RemoteAddr())
-		// TODO: Instead of this, have a method to shut down the server, maybe receiving from a channel
-		// ^ To do that server should probably wait until all goroutines are done before shutting down? (unless there's an option to force a close)
+		slog.Info("Accepted connection", "remote_addr", nConn.RemoteAddr())
 		if config.OneShot {
 			config.handleConn(nConn, serverConfig)
 			break
 		}
 
-		go config.handleConn(nConn, serverConfig)
+		conns.Add(1)
+		go func() {
+			defer conns.Done()
+			config.handleConn(nConn, serverConfig)
+		}()
+	}
+
+	// Give open connections some time to finish what they're doing
+	done := make(chan struct{})
+	go func() {
+		conns.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		slog.Info("All connections finished, shutting down")
+	case <-time.After(config.ShutdownTimeout):
+		slog.Warn("Timed out waiting for connections to finish, shutting down anyway")
 	}
 }
 
+// Wait for SIGINT/SIGTERM and stop accepting connections when we get one.
+// Readiness starts failing straight away, so there's a chance to stop sending clients our way before the listener goes.
+func (config *scpConfig) waitForShutdown(listener net.Listener) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	sig := <-signals
+	signal.Stop(signals)
+
+	slog.Info("Shutting down", "signal", sig.String())
+	config.state.shuttingDown.Store(true)
+	time.Sleep(config.ShutdownDelay)
+	config.state.accepting.Store(false)
+	listener.Close()
+}
+
 func (c scpConfig) initSSHConfig() *ssh.ServerConfig {
 	// An SSH server is represented by a ServerConfig, which holds
 	// certificate details and handles authentication of ServerConns.
@@ -246,7 +400,17 @@ func (c scpConfig) initSSHConfig() *ssh.ServerConfig {
 }
 
 func main() {
+	if len(os.Args) > 1 && (os.Args[1] == "get" || os.Args[1] == "put") {
+		os.Exit(clientMain(os.Args[1], os.Args[2:]))
+	}
+
 	config := initSettings()
 	serverConfig := config.initSSHConfig()
+	if len(config.AdminAddr) > 0 {
+		go startAdminServer(config)
+	}
+	if len(config.AdminSocket) > 0 {
+		go startAdminAPI(config)
+	}
 	startServer(config, serverConfig)
 }
@@ -8,9 +8,11 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
+
+	"github.com/FranGM/simplescp/scp"
+	"golang.org/x/crypto/ssh"
 )
-import "os/exec"
-import "time"
 
 // Testing idea:
 // Create sample files/directory structure in support/testing/blah
@@ -20,11 +22,6 @@ import "time"
 // Compare the whole directory structure
 // some kind of teardown to delete the files copied?
 
-// To give scp a password, do this:
-//   export SIMPLESCP_TESTPASS="hunter2"
-//   export SSH_ASKPASS=./bla.sh  # blah.sh just prints the password to stdin
-//   setsid -w scp ...
-
 type testConf struct {
 	src      string
 	dst      string
@@ -34,6 +31,9 @@ type testConf struct {
 
 func (conf testConf) runCopyTest() error {
 	err := cleanupDir(conf.dst)
+	if err == nil {
+		err = os.MkdirAll(conf.dst, 0755)
+	}
 	if err != nil {
 		conf.t.Fatalf("Error preparing for test: %q", err)
 	}
@@ -47,18 +47,17 @@ func (conf testConf) runCopyTest() error {
 	go startServer(c, serverConfig)
 	time.Sleep(500 * time.Millisecond)
 
-	// Look into SSH_ASKPASS to specify a binary to ask for ssh password
-	cmd := exec.Command("setsid", "-w", "scp", "-P", "2222", "scpuser@localhost:*", conf.dst)
-	//	cmd := exec.Command("tty")
-	cmd.Env = append(cmd.Env, "SIMPLESCP_TESTPASS="+conf.password)
-	cmd.Env = append(cmd.Env, "SSH_ASKPASS=support/ssh_pass.sh")
-	cmd.Env = append(cmd.Env, "DISPLAY=totallybogus")
-
-	// TODO: maybe separate stdout and stderr here
-	//err := cmd.Run()
-	out, err := cmd.CombinedOutput()
+	client, err := ssh.Dial("tcp", "localhost:2222", &ssh.ClientConfig{
+		User:            "scpuser",
+		Auth:            []ssh.AuthMethod{ssh.Password(conf.password)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		conf.t.Fatal(err)
+	}
+	defer client.Close()
 
-	fmt.Println(string(out))
+	err = scp.Copy(client, []string{"localhost:*"}, conf.dst, scp.Options{})
 	if err != nil {
 		conf.t.Fatal(err)
 	}
@@ -77,6 +76,7 @@ func TestSource(t *testing.T) {
 		dst:      "support/test/files/test1/dst",
 		src:      "support/test/files/test1/src",
 		password: "12345",
+		t:        t,
 	}
 
 	c.runCopyTest()
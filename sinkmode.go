@@ -2,269 +2,212 @@ package main
 
 import (
 	"errors"
-	"fmt"
-	"io"
+	"log/slog"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
-	"github.com/FranGM/simplelog"
+	"github.com/FranGM/simplescp/scp"
 	"golang.org/x/crypto/ssh"
 )
 
-func sendSCPBinaryOK(channel ssh.Channel) error {
-	_, err := channel.Write([]byte("\000"))
-	return err
-}
-
-type controlMessage struct {
-	msgType string
-	name    string
-	mode    os.FileMode
-	size    uint64
-	mtime   int64
-	atime   int64
-}
-
-// TODO: Cleanup, send errors on protocol errors
-func receiveControlMsg(channel ssh.Channel) (controlMessage, error) {
-	ctrlmsg := controlMessage{}
-
-	ctrlmsgbuf := make([]byte, 256)
-	nread, err := channel.Read(ctrlmsgbuf)
-	if err != nil {
-		// TODO: Maybe only return it upstream if it's an EOF, otherwise handle it?
-		return ctrlmsg, err
-	}
-	ctrlmsg.msgType = string(ctrlmsgbuf[0])
-
-	ctrlmsglist := strings.Split(string(ctrlmsgbuf[:nread]), " ")
-	simplelog.Debug.Printf("%v", ctrlmsglist)
-
-	// Make sure control message is valid
-	switch string(ctrlmsgbuf[0]) {
-	case "E":
-		if nread > 2 {
-			// TODO: Protocol error
-			simplelog.Error.Printf("Protocol error, got: %v", string(ctrlmsgbuf[:nread]))
-			return ctrlmsg, errors.New("Protocol error")
-		}
-		err := sendSCPBinaryOK(channel)
-		return ctrlmsg, err
-	case "C":
-	case "D":
-	case "T":
-	default:
-		// TODO: We have an expected message here, report it and abort
-	}
-
-	if ctrlmsg.msgType == "T" {
-		ctrlmsg.mtime, err = strconv.ParseInt(ctrlmsglist[0][1:], 10, 64)
-		if err != nil {
-			return ctrlmsg, errors.New("mtime.sec not delimited")
-		}
-		ctrlmsg.atime, err = strconv.ParseInt(ctrlmsglist[2], 10, 64)
-		if err != nil {
-			return ctrlmsg, errors.New("atime.sec not delimited")
-		}
-		sendSCPBinaryOK(channel)
-		// A "T" message will always come before a "D" or "C", so we can combine both
-		newCtrlmsg, err := receiveControlMsg(channel)
-		if err != nil {
-			return ctrlmsg, errors.New("Protocol error")
-		}
-
-		newCtrlmsg.mtime = ctrlmsg.mtime
-		newCtrlmsg.atime = ctrlmsg.atime
-
-		return newCtrlmsg, nil
+// Seconds since the epoch of t, or 0 if t isn't set (like for files that came without a T message)
+func unixTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
 	}
-
-	if len(ctrlmsglist) != 3 {
-		return ctrlmsg, errors.New("Protocol error")
-	}
-
-	ctrlmsg.name = ctrlmsglist[2][:len(ctrlmsglist[2])-1] // Remove trailing newline
-	size, err := strconv.ParseInt(ctrlmsglist[1], 10, 64)
-	ctrlmsg.size = uint64(size)
-	if err != nil {
-		return ctrlmsg, errors.New("Protocol error")
-	}
-	mode, err := strconv.ParseInt(ctrlmsglist[0][1:], 8, 32)
-	ctrlmsg.mode = os.FileMode(mode)
-	if err != nil {
-		return ctrlmsg, errors.New("Protocol error")
-	}
-	sendSCPBinaryOK(channel)
-	return ctrlmsg, nil
+	return t.Unix()
 }
 
-// Generate a full path out of our basedir, the directories currently in the stack, and the target
+// Generate a full path out of our basedir, the directories currently in the stack, and the target.
+// Everything after the basedir is taken as relative to it, even with a volume name (like "C:\dir" on Windows)
 func (config scpConfig) generatePath(dirStack []string, target string) string {
 	var fullPathList []string
 	fullPathList = append(fullPathList, config.Dir)
 	fullPathList = append(fullPathList, dirStack...)
 	fullPathList = append(fullPathList, target)
+	for i, elem := range fullPathList[1:] {
+		fullPathList[i+1] = strings.TrimPrefix(elem, filepath.VolumeName(elem))
+	}
 
 	path := filepath.Clean(filepath.Join(fullPathList...))
 
 	return path
 }
 
-// Receive the contents of a file and store it in the right place
-func (c scpConfig) receiveFileContents(channel ssh.Channel, dirStack []string, msgctrl controlMessage, name string, preserveMode bool) error {
-
-	filename := c.generatePath(dirStack, name)
-
-	simplelog.Debug.Printf("Filename is '%s'", filename)
-	// TODO: Make sure we're reporting the right error here if something happens
-	f, err := os.Create(filename)
-	if err != nil {
-		simplelog.Error.Printf("Err is %v", err)
-		return err
-	}
-	defer f.Close()
-	nread, err := io.CopyN(f, channel, int64(msgctrl.size))
-	simplelog.Debug.Printf("Transferred %d bytes", nread)
-	if err != nil {
-		simplelog.Error.Printf("Err is %v", err)
-		return err
-	}
-
-	// TODO: Double check that we're doing the right thing in all cases (file already exists, file doesn't exist, etc)
-	err = f.Chmod(msgctrl.mode)
-	if err != nil {
-		simplelog.Error.Printf("Err is %v", err)
-		return err
-	}
-
-	if preserveMode {
-		atime := time.Unix(msgctrl.atime, 0)
-		mtime := time.Unix(msgctrl.mtime, 0)
-		err := os.Chtimes(filename, atime, mtime)
-		if err != nil {
-			simplelog.Error.Printf("Err is %v", err)
-			return err
+// Create a directory, ignore errors if it already exists. Returns whether it had to be created.
+// Like with scp, new directories get whatever owner permissions we need to store things in them
+// on top of mode, until finishDir sets their final mode.
+func createDir(target string, mode os.FileMode, log *slog.Logger) (bool, error) {
+	err := os.Mkdir(target, mode&os.ModePerm|0700)
+	if err == nil {
+		return true, nil
+	}
+	if errors.Is(err, os.ErrExist) {
+		if fi, serr := os.Stat(target); serr == nil && fi.IsDir() {
+			log.Debug("Directory already exists", "path", target)
+			return false, nil
 		}
+		// Whatever is there, we can't put files in it
+		err = &os.PathError{Op: "mkdir", Path: target, Err: syscall.ENOTDIR}
 	}
-
-	statusbuf := make([]byte, 1)
-	_, err = channel.Read(statusbuf)
-	if err != nil {
-		simplelog.Error.Printf("Getting status error after transfer: %v", err)
-		return err
-	}
-	sendSCPBinaryOK(channel)
-	return err
+	log.Error("Unable to create directory", "path", target, "err", err)
+	return false, err
 }
 
-// Create a directory, ignore errors if it already exists
-func createDir(target string) error {
-	// TODO: What permissions should we use here?
-	var perm os.FileMode = 0755
-	err := os.Mkdir(target, perm)
-	if err != nil {
-		// TODO: it's easier to compare to os.ErrExist
-		if os.IsExist(err) {
-			simplelog.Warning.Printf("File already exists, big deal")
-		} else {
-			simplelog.Error.Printf("%v", err)
-			return err
-		}
+// Give a directory its final mode and times, once everything in it has been received.
+// Same as scp, directories that already existed only get their mode changed with -p,
+// and times are only restored with -p.
+func finishDir(path string, mode os.FileMode, msg scp.Message, created bool, preserveMode bool) error {
+	if !created && !preserveMode {
+		return nil
+	}
+	err := os.Chmod(path, mode)
+	if err == nil && preserveMode && msg.HasTimes() {
+		err = os.Chtimes(path, msg.Atime, msg.Mtime)
 	}
-	return nil
+	return err
 }
 
 // If target exists and it's a dir, put all the files in there
 // If target doesn't exist or it's a regular file:
 //   - If we only want to copy one file, use it as destination
 //   - If we want to copy more than one file, it's an error: "No such file or directory" or "Not a directory"
-func (config scpConfig) startSCPSink(channel ssh.Channel, opts scpOptions) error {
+//
+// Files that can't be stored are reported to the client and skipped, same as scp does.
+// Returns the first error found, if any
+func (config scpConfig) startSCPSink(channel ssh.Channel, opts scpOptions, conn *connState) error {
+
+	// Control messages and file contents all need to go through the same buffer
+	stream := scp.NewConn(channel)
 
 	// Only one target should have been specified
 	target := opts.fileNames[0]
 
 	// Target seems to be a directory
-	if string(target[len(target)-1]) == "/" {
+	if strings.HasSuffix(target, "/") {
 		opts.TargetIsDir = true
 	}
 
-	absTarget := filepath.Clean(filepath.Join(config.Dir, target))
-	if !strings.HasPrefix(absTarget, config.Dir) {
+	absTarget := config.generatePath(nil, target)
+	if !insideDir(config.Dir, absTarget) {
 		// We're attempting to copy files outside of our working directory, so return an error
-		msg := fmt.Sprintf("scp: %s: Not a directory", target)
-		sendErrorToClient(msg, channel)
-		return errors.New(msg)
+		err := &os.PathError{Op: "receive", Path: target, Err: syscall.ENOTDIR}
+		stream.SendError(target, err)
+		return err
 	}
 
-	var dirStack []string
+	// Same as scp, anything we receive goes inside target if it's an existing directory
+	if fi, err := os.Stat(absTarget); err == nil && fi.IsDir() {
+		opts.TargetIsDir = true
+	}
 
 	if opts.TargetIsDir {
-		err := createDir(absTarget)
+		mode := config.uploadDirMode(conn.user, 0755)
+		created, err := createDir(absTarget, mode, conn.log)
+		if err == nil && created {
+			err = os.Chmod(absTarget, mode)
+			if err == nil {
+				err = config.chownUpload(absTarget)
+			}
+		}
 		if err != nil {
+			stream.SendError(target, err)
 			return err
 		}
-		dirStack = append(dirStack, target)
 	}
 
-	simplelog.Debug.Printf("Dir stack is: %v", dirStack)
+	// Directories at the top are the roots of a recursive upload, and get a manifest written once received
+	depth := 0
+	var currentManifest *manifest
 
-	// Tell the other side we're ready to start receiving data
-	sendSCPBinaryOK(channel)
-	for {
-		ctrlmsg, err := receiveControlMsg(channel)
-
-		if err != nil {
-			if err == io.EOF {
-				// EOF is fine at this point, it just means no more files to copy
-				break
+	hooks := scp.ReceiveHooks{
+		Path: config.jailedPath,
+		Mkdir: func(name string, path string, msg scp.Message) (bool, error) {
+			if isIncompleteUpload(name) {
+				// Downloads would skip it, same as with files
+				return false, &scp.PolicyError{Name: name, Err: errReservedName}
+			}
+			mode := config.uploadDirMode(conn.user, msg.Mode)
+			created, err := createDir(path, mode, conn.log)
+			if err == nil && created {
+				err = config.chownUpload(path)
 			}
-			simplelog.Error.Printf("Got error from client: %v", err)
-			break
-		}
-
-		simplelog.Debug.Printf("Message type: %v", ctrlmsg.msgType)
-		switch ctrlmsg.msgType {
-		case "D":
-			// TODO: Figure out how we need to behave in terms of permissions/times, etc
-			err := createDir(config.generatePath(dirStack, ctrlmsg.name))
 			if err != nil {
-				return err
+				return false, err
 			}
-			dirStack = append(dirStack, ctrlmsg.name)
-			simplelog.Debug.Printf("dir stack is now: %v", dirStack)
-		case "E":
-			stackSize := len(dirStack)
-			if (opts.TargetIsDir && stackSize <= 1) || (!opts.TargetIsDir && stackSize <= 0) {
-				msg := "scp: Protocol Error"
-				sendErrorToClient(msg, channel)
-				return errors.New(msg)
+			if len(config.Manifest) > 0 && depth == 0 {
+				currentManifest = &manifest{root: path}
+			} else if currentManifest != nil {
+				currentManifest.addDir(path, mode, msg.Mtime)
 			}
-			dirStack = dirStack[:len(dirStack)-1]
-		case "C":
-			var filename string
-			if opts.TargetIsDir {
-				filename = ctrlmsg.name
-			} else {
-				filename = target
+			depth++
+			conn.log.Debug("Entered directory", "path", path)
+			return created, nil
+		},
+		FinishDir: func(name string, path string, msg scp.Message, created bool) error {
+			depth--
+			if currentManifest != nil && depth == 0 {
+				err := currentManifest.write(config, conn.user)
+				if err != nil {
+					conn.log.Error("Unable to write manifest", "path", currentManifest.root, "err", err)
+				}
+				currentManifest = nil
 			}
-			config.receiveFileContents(channel, dirStack, ctrlmsg, filename, opts.PreserveMode)
-		}
-
-		// Steps here:
-		// 1. Figure out what kind of message this is (file, directory, time, end of directory...)
-		// If it's D:
-		//   - Add a new directory to the stack
-		//   - Create the directory
-		// If it's E:
-		//   - Remove one directory from the stack
-		// If it's C:
-		//   - Receive file and store it in the current stack
-		// If it's T:
-		//   - Receive the next control message
-
+			// Only once the manifest is in, or it would change the directory's times
+			err := finishDir(path, config.uploadDirMode(conn.user, msg.Mode), msg, created, opts.PreserveMode)
+			if err != nil {
+				conn.log.Error("Unable to set directory mode or times", "path", path, "err", err)
+			}
+			return err
+		},
+		Create: func(name string, path string, msg scp.Message) (scp.File, error) {
+			start := time.Now()
+			policy := config.overwritePolicyFor(conn.user)
+			err := config.checkUploadPolicy(name, uint64(msg.Size), conn.log)
+			if err == nil {
+				err = config.checkQuota(conn.user, name, path, uint64(msg.Size), policy, conn.log)
+			}
+			if err == nil {
+				err = checkOverwrite(path, name, policy, conn.log)
+			}
+			if err != nil {
+				// Client will skip this file and carry on with the next one
+				config.recordTransfer(conn, "upload", path, msg.Size, start, nil, err)
+				return nil, err
+			}
+			u, err := config.startUpload(conn, path, msg, opts.PreserveMode, 0)
+			if err != nil {
+				config.recordTransfer(conn, "upload", path, msg.Size, start, nil, err)
+				return nil, err
+			}
+			u.done = func(rf receivedFile) {
+				if currentManifest != nil {
+					currentManifest.addFile(rf)
+				}
+			}
+			return u, nil
+		},
+		Report: func(err error) {
+			var perr *scp.ProtocolError
+			var rerr *scp.RemoteError
+			switch {
+			case errors.Is(err, scp.ErrUnexpectedEnd):
+				protocolErrors.WithLabelValues(errUnexpectedEnd).Inc()
+				conn.log.Error("Got error from client", "err", err)
+			case errors.As(err, &perr):
+				protocolErrors.WithLabelValues(errMalformedMessage).Inc()
+				conn.log.Error("Got error from client", "err", err)
+			case errors.As(err, &rerr):
+				reportClientError(err, conn.log)
+			default:
+				conn.log.Warn("Refusing file from client", "err", err)
+			}
+		},
 	}
-	return nil
+
+	conn.log.Debug("Starting sink", "target", absTarget)
+	return scp.ReceiveWith(stream, target, scp.Options{Recursive: opts.Recursive, TargetIsDir: opts.TargetIsDir}, hooks)
 }
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/FranGM/simplescp/scp"
+)
+
+func TestDirectoryModes(t *testing.T) {
+	base := t.TempDir()
+	mtime := time.Unix(1577934245, 0)
+	config := scpConfig{umask: 022, userDirModes: map[string]os.FileMode{"shared": 0770}}
+
+	tests := []struct {
+		name     string
+		user     string
+		mode     os.FileMode
+		preserve bool
+		expected os.FileMode
+	}{
+		{"plain", "scpuser", 0775, false, 0755},
+		{"readonly", "scpuser", 0555, false, 0555},
+		{"private", "scpuser", 0500, true, 0500},
+		{"special", "scpuser", 0777 | os.ModeSetgid | os.ModeSticky, true, 0755},
+		{"forced", "shared", 0700, false, 0770},
+	}
+
+	for _, test := range tests {
+		path := filepath.Join(base, test.name)
+		msg := scp.DirMessage(test.name, test.mode)
+		msg.Mtime, msg.Atime = mtime, mtime
+		mode := config.uploadDirMode(test.user, test.mode)
+		created, err := createDir(path, mode, slog.Default())
+		if err != nil || !created {
+			t.Fatalf("%s: createDir returned %v, %v", test.name, created, err)
+		}
+		// Files still need to go in there
+		err = os.WriteFile(filepath.Join(path, "file"), nil, 0644)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		err = finishDir(path, mode, msg, created, test.preserve)
+		if err != nil {
+			t.Fatalf("%s: finishDir: %v", test.name, err)
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode()&^os.ModeDir != test.expected {
+			t.Errorf("%s: expected mode %v, got %v", test.name, test.expected, fi.Mode())
+		}
+		if test.preserve && !fi.ModTime().Equal(mtime) {
+			t.Errorf("%s: expected mtime %v, got %v", test.name, mtime, fi.ModTime())
+		}
+		os.Chmod(path, 0700)
+	}
+
+	// Existing directories are reused, anything else is in the way
+	created, err := createDir(filepath.Join(base, "plain"), 0700, slog.Default())
+	if err != nil || created {
+		t.Errorf("Existing directory: createDir returned %v, %v", created, err)
+	}
+	_, err = createDir(filepath.Join(base, "plain", "file"), 0700, slog.Default())
+	if err == nil {
+		t.Errorf("Expected an error creating a directory over a file")
+	}
+}
+
+// ssh.Channel over one end of a net.Pipe, to run sink and source mode without an ssh connection
+type pipeChannel struct {
+	net.Conn
+}
+
+func (c pipeChannel) CloseWrite() error {
+	return nil
+}
+
+func (c pipeChannel) SendRequest(name string, wantReply bool, payload []byte) (bool, error) {
+	return true, nil
+}
+
+func (c pipeChannel) Stderr() io.ReadWriter {
+	return &bytes.Buffer{}
+}
+
+func checkTimes(t *testing.T, path string, mtime time.Time, atime time.Time) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotMtime, gotAtime := scp.FileTimes(path, fi)
+	if !gotMtime.Equal(mtime) || !gotAtime.Equal(atime) {
+		t.Errorf("%s: got mtime %v and atime %v, want %v and %v", path, gotMtime, gotAtime, mtime, atime)
+	}
+}
+
+// Upload paths into config's directory through sink mode
+func uploadPaths(config scpConfig, paths []string, opts scp.Options) (error, error) {
+	conn := &connState{user: "scpuser", remoteAddr: &net.TCPAddr{IP: net.IPv6loopback}, log: slog.Default()}
+	a, b := net.Pipe()
+	received := make(chan error, 1)
+	go func() {
+		received <- config.startSCPSink(pipeChannel{a}, scpOptions{To: true, Recursive: opts.Recursive, PreserveMode: opts.Preserve, fileNames: []string{"."}}, conn)
+		a.Close()
+	}()
+	err := scp.Send(scp.NewConn(b), paths, opts)
+	b.Close()
+	return <-received, err
+}
+
+func TestReservedNames(t *testing.T) {
+	src := t.TempDir()
+	config := scpConfig{Dir: t.TempDir()}
+	reserved := []string{".a.123" + tempFileSuffix, ".b.abc" + partialFileSuffix}
+	writeFiles(t, src, map[string]int{reserved[0]: 10, reserved[1]: 10, "ok": 10, "dir/" + reserved[0]: 10})
+
+	var paths []string
+	for _, name := range append(reserved, "ok", "dir") {
+		paths = append(paths, filepath.Join(src, name))
+	}
+	sinkErr, sendErr := uploadPaths(config, paths, scp.Options{Recursive: true})
+	if !errors.Is(sinkErr, errReservedName) || sendErr == nil {
+		t.Errorf("Expected uploads named like ours to be refused, got %v, %v", sinkErr, sendErr)
+	}
+
+	// Nothing is there to be mistaken for an upload in progress, and cleaning up leaves the rest alone
+	err := cleanupTempFiles(config.Dir, time.Nanosecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range append(reserved, filepath.Join("dir", reserved[0])) {
+		if _, err := os.Lstat(filepath.Join(config.Dir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s shouldn't have been stored (%v)", name, err)
+		}
+	}
+	for _, name := range []string{"ok", "dir"} {
+		if _, err := os.Stat(filepath.Join(config.Dir, name)); err != nil {
+			t.Errorf("Expected %s to be stored: %v", name, err)
+		}
+	}
+}
+
+func TestPreserveTimes(t *testing.T) {
+	src := t.TempDir()
+	dst := t.TempDir()
+	config := scpConfig{Dir: t.TempDir(), umask: 022}
+	conn := &connState{user: "scpuser", remoteAddr: &net.TCPAddr{IP: net.IPv6loopback}, log: slog.Default()}
+
+	// Times only make it through scp with microsecond precision
+	mtime := time.Unix(1500000000, 123456789)
+	atime := time.Unix(1600000000, 999999999)
+	wantMtime := time.Unix(1500000000, 123456000)
+	wantAtime := time.Unix(1600000000, 999999000)
+	file := filepath.Join(src, "file")
+	err := os.WriteFile(file, []byte("hello"), 0644)
+	if err == nil {
+		err = os.Chtimes(file, atime, mtime)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, b := net.Pipe()
+	received := make(chan error, 1)
+	go func() {
+		received <- config.startSCPSink(pipeChannel{a}, scpOptions{To: true, PreserveMode: true, fileNames: []string{"."}}, conn)
+	}()
+	err = scp.Send(scp.NewConn(b), []string{file}, scp.Options{Preserve: true})
+	b.Close()
+	if err != nil {
+		t.Fatalf("Sending to sink mode: %v", err)
+	}
+	if err := <-received; err != nil {
+		t.Fatalf("Sink mode: %v", err)
+	}
+	checkTimes(t, filepath.Join(config.Dir, "file"), wantMtime, wantAtime)
+
+	a, b = net.Pipe()
+	sent := make(chan error, 1)
+	go func() {
+		sent <- config.startSCPSource(pipeChannel{a}, scpOptions{From: true, PreserveMode: true, fileNames: []string{"file"}}, conn)
+		a.Close()
+	}()
+	err = scp.Receive(scp.NewConn(b), dst, scp.Options{Preserve: true})
+	if err != nil {
+		t.Fatalf("Receiving from source mode: %v", err)
+	}
+	if err := <-sent; err != nil {
+		t.Fatalf("Source mode: %v", err)
+	}
+	checkTimes(t, filepath.Join(dst, "file"), wantMtime, wantAtime)
+}
+
+func TestInterruptedUpload(t *testing.T) {
+	for _, resumable := range []bool{false, true} {
+		config := scpConfig{Dir: t.TempDir(), ResumableUploads: resumable}
+		conn := &connState{user: "scpuser", remoteAddr: &net.TCPAddr{IP: net.IPv6loopback}, log: slog.Default()}
+		a, b := net.Pipe()
+		received := make(chan error, 1)
+		go func() {
+			received <- config.startSCPSink(pipeChannel{a}, scpOptions{To: true, fileNames: []string{"."}}, conn)
+		}()
+
+		// The connection goes away halfway through the file
+		client := scp.NewConn(b)
+		err := client.ReadStatus()
+		if err == nil {
+			err = client.SendMessage(scp.FileMessage("file", 0644, 100))
+		}
+		if err == nil {
+			_, err = client.Write(make([]byte, 50))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.Close()
+		if err := <-received; err == nil {
+			t.Errorf("Expected an error from the sink")
+		}
+
+		entries, err := os.ReadDir(config.Dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !resumable {
+			if len(entries) > 0 {
+				t.Errorf("Expected nothing left behind, got %v", entries)
+			}
+			continue
+		}
+		// Unless it can be resumed, in which case what we got is kept out of sight
+		if len(entries) != 1 || !isPartialFile(entries[0].Name()) {
+			t.Fatalf("Expected only a partial file, got %v", entries)
+		}
+		fi, err := entries[0].Info()
+		if err != nil || fi.Size() != 50 || fi.Mode().Perm() != 0600 {
+			t.Errorf("Expected 50 bytes with mode 0600, got %v, %v", fi, err)
+		}
+	}
+}
+
+func TestUploadModes(t *testing.T) {
+	tests := []struct {
+		name     string
+		mode     os.FileMode
+		umask    os.FileMode
+		forced   os.FileMode
+		expected os.FileMode
+	}{
+		{"plain", 0644, 0, 0, 0644},
+		{"setuid", 0755 | os.ModeSetuid, 0, 0, 0755},
+		{"special", 0777 | os.ModeSetgid | os.ModeSticky, 022, 0, 0755},
+		{"umask", 0666, 027, 0, 0640},
+		{"forced", 0777 | os.ModeSetuid, 022, 0600, 0600},
+	}
+
+	for _, test := range tests {
+		config := scpConfig{Dir: t.TempDir(), umask: test.umask}
+		if test.forced != 0 {
+			config.userFileModes = map[string]os.FileMode{"scpuser": test.forced}
+		}
+		conn := &connState{user: "scpuser", remoteAddr: &net.TCPAddr{IP: net.IPv6loopback}, log: slog.Default()}
+		a, b := net.Pipe()
+		received := make(chan error, 1)
+		go func() {
+			received <- config.startSCPSink(pipeChannel{a}, scpOptions{To: true, fileNames: []string{"."}}, conn)
+			a.Close()
+		}()
+
+		// Modes straight from the client, whatever it could have on its side
+		client := scp.NewConn(b)
+		msg := scp.FileMessage(test.name, test.mode, 5)
+		err := client.ReadStatus()
+		if err == nil {
+			err = client.SendMessage(msg)
+		}
+		if err == nil {
+			_, err = client.WriteFile(msg, strings.NewReader("hello"))
+		}
+		b.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if err := <-received; err != nil {
+			t.Fatalf("%s: sink mode: %v", test.name, err)
+		}
+
+		fi, err := os.Stat(filepath.Join(config.Dir, test.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode() != test.expected {
+			t.Errorf("%s: expected mode %v, got %v", test.name, test.expected, fi.Mode())
+		}
+	}
+}
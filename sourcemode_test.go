@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/FranGM/simplescp/scp"
+)
+
+// Download names from config's directory into dst through source mode
+func download(config scpConfig, names []string, dst string, recursive bool) (error, error) {
+	conn := &connState{user: "scpuser", remoteAddr: &net.TCPAddr{IP: net.IPv6loopback}, log: slog.Default()}
+	a, b := net.Pipe()
+	sent := make(chan error, 1)
+	go func() {
+		sent <- config.startSCPSource(pipeChannel{a}, scpOptions{From: true, Recursive: recursive, fileNames: names}, conn)
+		a.Close()
+	}()
+	err := scp.Receive(scp.NewConn(b), dst, scp.Options{Recursive: recursive, TargetIsDir: true})
+	return <-sent, err
+}
+
+func TestSourceSkipsIncompleteUploads(t *testing.T) {
+	config := scpConfig{Dir: t.TempDir()}
+	writeFiles(t, config.Dir, map[string]int{
+		"a":                              10,
+		".a.123" + tempFileSuffix:        10,
+		"sub/b":                          10,
+		"sub/.c.abc" + partialFileSuffix: 10,
+	})
+
+	dst := t.TempDir()
+	// Globs match hidden files too
+	sourceErr, sinkErr := download(config, []string{"*"}, dst, true)
+	if sourceErr != nil || sinkErr != nil {
+		t.Fatalf("Unexpected errors: %v, %v", sourceErr, sinkErr)
+	}
+	var received []string
+	filepath.Walk(dst, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			rel, _ := filepath.Rel(dst, path)
+			received = append(received, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if len(received) != 2 || received[0] != "a" || received[1] != "sub/b" {
+		t.Errorf("Expected only a and sub/b, got %q", received)
+	}
+
+	// Asking for them by name doesn't work either
+	sourceErr, sinkErr = download(config, []string{".a.123" + tempFileSuffix}, t.TempDir(), true)
+	if sourceErr == nil || sinkErr == nil {
+		t.Errorf("Expected errors sending an upload in progress, got %v, %v", sourceErr, sinkErr)
+	}
+}
+
+func TestSourceRecordsFailures(t *testing.T) {
+	var log bytes.Buffer
+	config := scpConfig{Dir: t.TempDir(), audit: &auditLogger{w: &log}}
+	writeFiles(t, config.Dir, map[string]int{"sub/a": 10})
+	names := []string{"sub"}
+	if runtime.GOOS != "windows" {
+		err := os.Symlink(os.DevNull, filepath.Join(config.Dir, "null"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, "null")
+	}
+
+	// Neither a directory without -r nor a device can be sent, but both count as failed downloads
+	sourceErr, _ := download(config, names, t.TempDir(), false)
+	if !errors.Is(sourceErr, scp.ErrNotRegular) {
+		t.Errorf("Expected an error about what can't be sent, got %v", sourceErr)
+	}
+	lines := strings.Split(strings.TrimSpace(log.String()), "\n")
+	if len(lines) != len(names) {
+		t.Fatalf("Expected %d audit records, got %q", len(names), lines)
+	}
+	for i, line := range lines {
+		var record auditRecord
+		err := json.Unmarshal([]byte(line), &record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(config.Dir, names[i])
+		if record.Direction != "download" || record.Path != path || record.Result != "error" || record.Error == "" {
+			t.Errorf("Expected a failed download of %s, got %s", path, line)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// Where events about completed uploads are left for other programs to pick up, either:
+//   - A directory, where each event is written to its own "<time>-<session>-<n>.json" file. Files only show up
+//     under that name once completely written, so consumers should ignore hidden files.
+//   - A named pipe, where each event is written as a single JSON line.
+//
+// A nil eventSpool discards everything.
+type eventSpool struct {
+	path string
+	pipe bool
+	mu   sync.Mutex
+	seq  uint64
+}
+
+func (c *scpConfig) initEventSpool() error {
+	if len(c.EventSpool) == 0 {
+		return nil
+	}
+
+	fi, err := os.Stat(c.EventSpool)
+	if os.IsNotExist(err) {
+		err = os.MkdirAll(c.EventSpool, 0750)
+		if err != nil {
+			return err
+		}
+		fi, err = os.Stat(c.EventSpool)
+	}
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() && fi.Mode()&os.ModeNamedPipe == 0 {
+		return fmt.Errorf("Event spool %v is neither a directory nor a named pipe", c.EventSpool)
+	}
+
+	c.spool = &eventSpool{path: c.EventSpool, pipe: fi.Mode()&os.ModeNamedPipe != 0}
+	slog.Info("Writing upload events", "spool", c.EventSpool)
+	return nil
+}
+
+func (s *eventSpool) write(event hookEvent) error {
+	if s == nil {
+		return nil
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pipe {
+		return s.writeToPipe(append(data, '\n'))
+	}
+	s.seq++
+	name := fmt.Sprintf("%d-%s-%d.json", event.Time.UnixNano(), event.Session, s.seq)
+	return s.writeToDir(name, data)
+}
+
+// Don't wait around for a reader if nobody is listening on the pipe, the upload has already happened either way
+func (s *eventSpool) writeToPipe(line []byte) error {
+	f, err := os.OpenFile(s.path, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(line)
+	return err
+}
+
+// Write the event to a temporary file first, so consumers never see half written events
+func (s *eventSpool) writeToDir(name string, data []byte) error {
+	filename := filepath.Join(s.path, name)
+	f, err := createTempFile(filename)
+	if err != nil {
+		return err
+	}
+	// Only does something if we bail out before renaming the file into place
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(0640)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		return err
+	}
+	_, err = commitUpload(f, filename, overwriteReplace, slog.Default())
+	return err
+}
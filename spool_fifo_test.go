@@ -0,0 +1,52 @@
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestSpoolPipe(t *testing.T) {
+	config := scpConfig{EventSpool: filepath.Join(t.TempDir(), "events")}
+	if err := unix.Mkfifo(config.EventSpool, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.initEventSpool(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nobody is reading, so the event is dropped instead of blocking the upload
+	if err := config.spool.write(hookEvent{Event: eventPostUpload, Path: "lost"}); err == nil {
+		t.Errorf("Expected an error writing to a pipe without readers")
+	}
+
+	reader, err := os.OpenFile(config.EventSpool, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	for _, path := range []string{"a", "b"} {
+		if err := config.spool.write(hookEvent{Event: eventPostUpload, Path: path}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// One line per event
+	scanner := bufio.NewScanner(reader)
+	for _, path := range []string{"a", "b"} {
+		var event hookEvent
+		if !scanner.Scan() {
+			t.Fatalf("Expected an event for %s: %v", path, scanner.Err())
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil || event.Path != path {
+			t.Errorf("Expected an event for %s, got %s (%v)", path, scanner.Bytes(), err)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSpoolDirectory(t *testing.T) {
+	config := scpConfig{EventSpool: filepath.Join(t.TempDir(), "spool")}
+	// The directory is created if it's not there yet
+	if err := config.initEventSpool(); err != nil {
+		t.Fatal(err)
+	}
+
+	event := hookEvent{Event: eventPostUpload, Time: time.Now(), Session: "abc", Path: "file", Size: 10}
+	for i := 0; i < 2; i++ {
+		if err := config.spool.write(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Each event gets its own file, and no temporary file is left behind
+	entries, err := os.ReadDir(config.EventSpool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 events in the spool, got %v", entries)
+	}
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) != ".json" || isTempFile(entry.Name()) {
+			t.Errorf("Unexpected file %s in the spool", entry.Name())
+		}
+		data, err := os.ReadFile(filepath.Join(config.EventSpool, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got hookEvent
+		if err := json.Unmarshal(data, &got); err != nil || got.Path != "file" || got.Size != 10 {
+			t.Errorf("Unexpected event %s (%v)", data, err)
+		}
+	}
+}
+
+func TestSpoolNeedsDirectoryOrPipe(t *testing.T) {
+	config := scpConfig{EventSpool: filepath.Join(t.TempDir(), "file")}
+	writeFiles(t, filepath.Dir(config.EventSpool), map[string]int{"file": 1})
+	if err := config.initEventSpool(); err == nil {
+		t.Errorf("Expected an error using a regular file as the spool")
+	}
+
+	// Without a spool, events are just dropped
+	if err := (scpConfig{}).spool.write(hookEvent{}); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
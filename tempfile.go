@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Uploads in progress are stored as ".<name>.<random>.simplescp-tmp" next to their final location
+const tempFileSuffix = ".simplescp-tmp"
+
+// Create a hidden temporary file in the same directory as filename, so it can be renamed into place atomically
+func createTempFile(filename string) (*os.File, error) {
+	dir, base := filepath.Split(filename)
+	return ioutil.TempFile(dir, "."+base+".*"+tempFileSuffix)
+}
+
+// Close an upload that's been completely received and move it to filename, as allowed by policy.
+// Returns the path the upload was finally stored as.
+func commitUpload(f *os.File, filename string, policy overwritePolicy, log *slog.Logger) (string, error) {
+	err := f.Close()
+	if err != nil {
+		return "", err
+	}
+	filename, err = prepareOverwrite(filename, policy, log)
+	if err != nil {
+		return "", err
+	}
+	return filename, os.Rename(f.Name(), filename)
+}
+
+func isTempFile(name string) bool {
+	base := filepath.Base(name)
+	return strings.HasPrefix(base, ".") && strings.HasSuffix(base, tempFileSuffix)
+}
+
+// Whether name is an upload that hasn't made it into place yet. These are never sent to clients.
+func isIncompleteUpload(name string) bool {
+	return isTempFile(name) || isPartialFile(name)
+}
+
+// Remove any temporary files left behind by uploads that never finished (e.g. if we crashed mid transfer)
+// Partial files kept to resume uploads are only removed once they're older than partialMaxAge
+func cleanupTempFiles(dir string, partialMaxAge time.Duration) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			slog.Warn("Skipping path when looking for stale uploads", "path", path, "err", err)
+			return nil
+		}
+		if info.Mode().IsRegular() && isTempFile(path) {
+			slog.Info("Removing stale upload", "path", path)
+			err := os.Remove(path)
+			if err != nil {
+				slog.Error("Unable to remove stale upload", "path", path, "err", err)
+			}
+		}
+		if info.Mode().IsRegular() && isPartialFile(path) && partialMaxAge > 0 && time.Since(info.ModTime()) > partialMaxAge {
+			slog.Info("Removing expired partial upload", "path", path)
+			err := os.Remove(path)
+			if err != nil {
+				slog.Error("Unable to remove partial upload", "path", path, "err", err)
+			}
+		}
+		return nil
+	})
+}
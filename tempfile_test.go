@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCleanupTempFiles(t *testing.T) {
+	dir := t.TempDir()
+	stale := filepath.Join("sub", ".a.123"+tempFileSuffix)
+	oldPartial := ".b.abc" + partialFileSuffix
+	newPartial := filepath.Join("sub", ".c.abc"+partialFileSuffix)
+	writeFiles(t, dir, map[string]int{stale: 10, oldPartial: 10, newPartial: 10, "a": 10, ".hidden": 10})
+	old := time.Now().Add(-2 * time.Hour)
+	err := os.Chtimes(filepath.Join(dir, oldPartial), old, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = cleanupTempFiles(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, kept := range map[string]bool{stale: false, oldPartial: false, newPartial: true, "a": true, ".hidden": true} {
+		_, err := os.Stat(filepath.Join(dir, name))
+		if kept && err != nil {
+			t.Errorf("Expected %s to be kept: %v", name, err)
+		}
+		if !kept && !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be removed, got %v", name, err)
+		}
+	}
+
+	// Without a maximum age, partial files are kept forever
+	err = os.Chtimes(filepath.Join(dir, newPartial), old, old)
+	if err == nil {
+		err = cleanupTempFiles(dir, 0)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, newPartial)); err != nil {
+		t.Errorf("Expected %s to be kept: %v", newPartial, err)
+	}
+}
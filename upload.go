@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/FranGM/simplescp/scp"
+)
+
+// File being uploaded. It's written to a hidden temporary file (or a partial one, with resumable uploads)
+// that only replaces path once committed. Either way, the upload is recorded like any other transfer.
+type upload struct {
+	config   scpConfig
+	conn     *connState
+	f        *os.File
+	path     string      // Where it ends up
+	msg      scp.Message // Its full size, and the mode and times the client sent
+	preserve bool        // Whether to keep the client's times
+	policy   overwritePolicy
+	start    time.Time
+	size     int64 // Bytes we have, including any received before resuming
+	hashes   transferHashes
+	w        io.Writer
+	transfer *transferProgress
+	done     func(receivedFile) // Called once the upload is in place, if set
+}
+
+// Start an upload of what msg announces to path. With resumable uploads, it carries on from offset
+// with whatever was received before, otherwise offset has to be 0.
+func (config scpConfig) startUpload(conn *connState, path string, msg scp.Message, preserve bool, offset int64) (*upload, error) {
+	u := &upload{
+		config:   config,
+		conn:     conn,
+		path:     path,
+		msg:      msg,
+		preserve: preserve,
+		policy:   config.overwritePolicyFor(conn.user),
+		start:    time.Now(),
+		size:     offset,
+		hashes:   config.newTransferHashes(),
+	}
+
+	var err error
+	if config.ResumableUploads {
+		// Keep what we get, so it can be resumed later through simplescp-resume
+		u.f, err = os.OpenFile(partialFilePath(path, uint64(msg.Size), unixTime(msg.Mtime)), os.O_RDWR|os.O_CREATE, 0600)
+		if err == nil {
+			err = u.resumeAt(offset)
+			if err != nil {
+				u.f.Close()
+			}
+		}
+	} else if offset > 0 {
+		err = fmt.Errorf("can't resume at offset %d without resumable uploads", offset)
+	} else {
+		u.f, err = createTempFile(path)
+	}
+	if err != nil {
+		conn.log.Error("Error receiving file", "path", path, "err", err)
+		return nil, err
+	}
+
+	conn.log.Debug("Receiving file", "path", path, "offset", offset)
+	u.w, u.transfer = conn.startTransfer("upload", path, msg.Size-offset, io.MultiWriter(u.f, u.hashes.writer()))
+	return u, nil
+}
+
+// Discard anything in the partial file after offset, and hash what's left so checksums cover the whole file
+func (u *upload) resumeAt(offset int64) error {
+	fi, err := u.f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() < offset {
+		return fmt.Errorf("can't resume at offset %d, only %d bytes were received", offset, fi.Size())
+	}
+	err = u.f.Truncate(offset)
+	if err == nil {
+		_, err = io.CopyN(u.hashes.writer(), u.f, offset)
+	}
+	return err
+}
+
+func (u *upload) Write(data []byte) (int, error) {
+	n, err := u.w.Write(data)
+	u.size += int64(n)
+	return n, err
+}
+
+// Put the upload in place once all of it has been received
+func (u *upload) Commit() error {
+	u.conn.endTransfer(u.transfer)
+	mode := u.config.uploadFileMode(u.conn.user, u.msg.Mode)
+	err := u.f.Chmod(mode)
+	if err == nil {
+		err = u.config.chownUpload(u.f.Name())
+	}
+	if err == nil {
+		err = u.f.Sync()
+	}
+	if err == nil && u.preserve && u.msg.HasTimes() {
+		err = os.Chtimes(u.f.Name(), u.msg.Atime, u.msg.Mtime)
+	}
+	if err != nil {
+		return err
+	}
+
+	bytes, files := uploadDelta(u.path, uint64(u.size), u.policy)
+	path, err := commitUpload(u.f, u.path, u.policy, u.conn.log)
+	if err != nil {
+		return err
+	}
+	u.config.usage.add(bytes, files)
+	sums := u.hashes.sums()
+	u.conn.log.Info("Received file", "path", path, "bytes", u.size, "checksums", sums)
+
+	event := newHookEvent(eventPostUpload, u.conn)
+	event.Path = path
+	event.Size = u.size
+	event.Checksums = sums
+	err = u.config.spool.write(event)
+	if err != nil {
+		// The file is already in place, so this isn't something the client needs to hear about
+		u.conn.log.Error("Unable to write upload event to spool", "path", path, "err", err)
+	}
+
+	u.config.recordTransfer(u.conn, "upload", path, u.size, u.start, sums, nil)
+	if u.done != nil {
+		u.done(receivedFile{path: path, size: u.size, mode: mode, mtime: u.msg.Mtime, sums: sums})
+	}
+	return nil
+}
+
+// Give up on the upload. Partial files are kept, so it can be resumed
+func (u *upload) Abort(err error) {
+	u.conn.endTransfer(u.transfer)
+	u.f.Close()
+	if !u.config.ResumableUploads {
+		os.Remove(u.f.Name())
+	}
+	u.conn.log.Error("Error receiving file", "path", u.path, "err", err)
+	u.config.recordTransfer(u.conn, "upload", u.path, u.size, u.start, nil, err)
+}